@@ -0,0 +1,291 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	BLOBS_DIR        = ".blobs"
+	BLOB_POINTER_EXT = ".blobref"
+	// Blobs younger than this are never collected, so a blob that was just
+	// stored but not linked yet by a running archiver is not lost.
+	BLOB_GC_GRACE = time.Hour
+)
+
+// BlobStore is a content-addressed store of media shared by every conversation
+// of an output directory. Blobs are named by their SHA-256 and conversations
+// reference them through hardlinks, or pointer files where hardlinks are not
+// supported.
+type BlobStore struct {
+	Root string
+}
+
+func NewBlobStore(outputDir string) *BlobStore {
+	return &BlobStore{Root: filepath.Join(outputDir, BLOBS_DIR)}
+}
+
+func (store *BlobStore) blobPath(sum string) string {
+	return filepath.Join(store.Root, sum[:2], sum)
+}
+
+// Put stores data unless a blob with the same content already exists and
+// returns its SHA-256.
+func (store *BlobStore) Put(data []byte) (string, error) {
+	sum := sha256Hex(data)
+	path := store.blobPath(sum)
+	if info, err := os.Stat(path); err == nil && info.Size() == int64(len(data)) {
+		// Refresh the blob so a concurrent gc leaves it alone until it is linked.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return sum, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to write blob %s: %w", sum, err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to store blob %s: %w", sum, err)
+	}
+	return sum, nil
+}
+
+// Link makes target reference the blob. A hardlink is used when possible,
+// otherwise a small pointer file is written next to target.
+func (store *BlobStore) Link(sum string, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	os.Remove(target)
+	err = os.Link(store.blobPath(sum), target)
+	if err == nil {
+		os.Remove(target + BLOB_POINTER_EXT)
+		return nil
+	}
+
+	err = os.WriteFile(target+BLOB_POINTER_EXT, []byte("sha256:"+sum+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write blob pointer for %s: %w", target, err)
+	}
+	return nil
+}
+
+func readBlobPointer(pointerPath string) (string, error) {
+	content, err := os.ReadFile(pointerPath)
+	if err != nil {
+		return "", err
+	}
+	sum := strings.TrimPrefix(strings.TrimSpace(string(content)), "sha256:")
+	if len(sum) != 64 {
+		return "", fmt.Errorf("invalid blob pointer %s", pointerPath)
+	}
+	return sum, nil
+}
+
+// Read returns the content of a media file whether it is a regular file, a
+// hardlink to a blob or a pointer file.
+func (store *BlobStore) Read(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+	sum, pointerErr := readBlobPointer(path + BLOB_POINTER_EXT)
+	if pointerErr != nil {
+		return nil, err
+	}
+	return os.ReadFile(store.blobPath(sum))
+}
+
+type BlobStats struct {
+	Blobs             int
+	BlobBytes         int64
+	References        int
+	ReferencedBytes   int64
+	UnreferencedBlobs int
+	SavedBytes        int64
+}
+
+// references counts, per blob, the files of every conversation that still
+// point to it: the pointer files, including the ones older versions wrote for
+// events, and every file that is a hardlink to the blob, wherever it is in the
+// conversation directory.
+func (store *BlobStore) references(outputDir string) (map[string]int, error) {
+	// Only files of the same size as a blob can be one of its hardlinks.
+	blobsBySize := make(map[int64][]blobFile)
+	err := store.walk(func(sum string, path string, info fs.FileInfo) error {
+		blobsBySize[info.Size()] = append(blobsBySize[info.Size()], blobFile{sum, info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]int)
+	conversations, err := conversationDirs(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, conversationPath := range conversations {
+		err = filepath.WalkDir(conversationPath, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			if filepath.Ext(path) == BLOB_POINTER_EXT {
+				if sum, err := readBlobPointer(path); err == nil {
+					refs[sum]++
+				}
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			for _, blob := range blobsBySize[info.Size()] {
+				if os.SameFile(info, blob.info) {
+					refs[blob.sum]++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list blob references of %s: %w", conversationPath, err)
+		}
+	}
+	return refs, nil
+}
+
+type blobFile struct {
+	sum  string
+	info fs.FileInfo
+}
+
+func conversationDirs(outputDir string) ([]string, error) {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list output directory %s: %w", outputDir, err)
+	}
+	dirs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != BLOBS_DIR {
+			dirs = append(dirs, filepath.Join(outputDir, entry.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+func fileOrPointerExists(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	_, err := os.Stat(path + BLOB_POINTER_EXT)
+	return err == nil
+}
+
+func (store *BlobStore) walk(fn func(sum string, path string, info fs.FileInfo) error) error {
+	err := filepath.WalkDir(store.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) == ".tmp" {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(entry.Name(), path, info)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk blob store %s: %w", store.Root, err)
+	}
+	return nil
+}
+
+func (store *BlobStore) Stats(outputDir string) (*BlobStats, error) {
+	refs, err := store.references(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats BlobStats
+	err = store.walk(func(sum string, path string, info fs.FileInfo) error {
+		stats.Blobs++
+		stats.BlobBytes += info.Size()
+		count := refs[sum]
+		if count == 0 {
+			stats.UnreferencedBlobs++
+			return nil
+		}
+		stats.References += count
+		stats.ReferencedBytes += int64(count) * info.Size()
+		stats.SavedBytes += int64(count-1) * info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// GC removes the blobs that no conversation references anymore and returns how
+// many blobs and bytes were freed. It holds the lock of every conversation
+// meanwhile, so no archiver links a blob that is being removed, and fails when
+// one of them is in use.
+func (store *BlobStore) GC(outputDir string) (int, int64, error) {
+	conversations, err := conversationDirs(outputDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, conversationPath := range conversations {
+		lock, err := AcquireLock(conversationPath)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer func() {
+			err := lock.Release()
+			if err != nil {
+				logger.EventsLogger.Printf("Failed to release conversation lock: %v\n", err)
+			}
+		}()
+	}
+
+	refs, err := store.references(outputDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	freed := int64(0)
+	err = store.walk(func(sum string, path string, info fs.FileInfo) error {
+		if refs[sum] > 0 || time.Since(info.ModTime()) < BLOB_GC_GRACE {
+			return nil
+		}
+		err := os.Remove(path)
+		if err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
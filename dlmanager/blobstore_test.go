@@ -0,0 +1,85 @@
+package dlmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func putOldBlob(t *testing.T, store *BlobStore, data string) string {
+	t.Helper()
+	sum, err := store.Put([]byte(data))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	old := time.Now().Add(-2 * BLOB_GC_GRACE)
+	os.Chtimes(store.blobPath(sum), old, old)
+	return sum
+}
+
+func TestBlobStoreGC(t *testing.T) {
+	dir := t.TempDir()
+	store := NewBlobStore(dir)
+	conversation := filepath.Join(dir, "1-2")
+
+	linked := putOldBlob(t, store, "linked photo")
+	if err := store.Link(linked, filepath.Join(conversation, "photos", "1_10.jpg")); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	// A hardlink no manifest lists, such as a file moved by hand.
+	copied := putOldBlob(t, store, "copied photo")
+	if err := os.Link(store.blobPath(copied), filepath.Join(conversation, "photo copy.jpg")); err != nil {
+		t.Fatalf("failed to link blob: %v", err)
+	}
+	pointed := putOldBlob(t, store, "pointed photo")
+	if err := os.WriteFile(filepath.Join(conversation, "photos", "1_11.jpg"+BLOB_POINTER_EXT), []byte("sha256:"+pointed+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write blob pointer: %v", err)
+	}
+	unreferenced := putOldBlob(t, store, "unreferenced photo")
+	young, err := store.Put([]byte("photo being linked"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	removed, freed, err := store.GC(dir)
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if removed != 1 || freed != int64(len("unreferenced photo")) {
+		t.Errorf("GC removed %d blobs of %d bytes, want 1 of %d", removed, freed, len("unreferenced photo"))
+	}
+	for sum, kept := range map[string]bool{linked: true, copied: true, pointed: true, young: true, unreferenced: false} {
+		if _, err := os.Stat(store.blobPath(sum)); (err == nil) != kept {
+			t.Errorf("blob %s kept = %v, want %v", sum, err == nil, kept)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(conversation, LOCK_FILE)); !os.IsNotExist(err) {
+		t.Errorf("GC left the conversation locked")
+	}
+}
+
+func TestBlobStoreGCLockedConversation(t *testing.T) {
+	dir := t.TempDir()
+	store := NewBlobStore(dir)
+	unreferenced := putOldBlob(t, store, "unreferenced photo")
+	writeLockOwner(t, mustMkdir(t, filepath.Join(dir, "1-2")), lockOwner(t, os.Getppid()))
+
+	_, _, err := store.GC(dir)
+	var locked *ErrLocked
+	if !errors.As(err, &locked) {
+		t.Fatalf("GC = %v, want %T", err, locked)
+	}
+	if _, err := os.Stat(store.blobPath(unreferenced)); err != nil {
+		t.Errorf("GC removed a blob while a conversation is in use")
+	}
+}
+
+func mustMkdir(t *testing.T, dir string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	return dir
+}
@@ -0,0 +1,152 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/utils"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	EVENT_EXT            = ".json"
+	COMPRESSED_EVENT_EXT = ".json.gz"
+)
+
+// eventPageNames lists the stored event pages. A page that exists both plain
+// and compressed, left behind by an interrupted compress, is listed once.
+func (dlManager *DLManager) eventPageNames() ([]string, error) {
+	names, err := dlManager.Storage.List(EVENTS_DIR + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events: %w", err)
+	}
+	stored := make(map[string]bool, len(names))
+	for _, name := range names {
+		stored[name] = true
+	}
+	pages := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, EVENT_EXT) && stored[name+".gz"] {
+			continue
+		}
+		pages = append(pages, name)
+	}
+	return pages, nil
+}
+
+func eventPageName(maxId string, compressed bool) string {
+	if compressed {
+		return EVENTS_DIR + "/" + maxId + COMPRESSED_EVENT_EXT
+	}
+	return EVENTS_DIR + "/" + maxId + EVENT_EXT
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// readEventPage returns the JSON of a stored event page, decompressing it when
+// needed.
+func (dlManager *DLManager) readEventPage(name string) ([]byte, error) {
+	data, err := dlManager.Storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(name, ".gz") {
+		data, err = gunzipBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %w", name, err)
+		}
+	}
+	return data, nil
+}
+
+// canDelete reports whether files can be removed from the storage, which
+// archive files do not support.
+func canDelete(storage Storage) bool {
+	if encrypted, ok := storage.(*EncryptedStorage); ok {
+		storage = encrypted.inner
+	}
+	_, ok := storage.(*DirStorage)
+	return ok
+}
+
+type CompressReport struct {
+	Compressed int
+	Before     int64
+	After      int64
+}
+
+func (report *CompressReport) Print() {
+	logger.EventsLogger.Printf("Compressed %d event pages from %s to %s\n", report.Compressed, utils.FormatBytes(report.Before), utils.FormatBytes(report.After))
+}
+
+// CompressEvents replaces every plain event page with a gzip compressed one.
+// The compressed page is written and read back before the plain page is
+// removed, so an interruption never loses a page.
+func (dlManager *DLManager) CompressEvents() (*CompressReport, error) {
+	if !canDelete(dlManager.Storage) {
+		return nil, fmt.Errorf("event pages can only be compressed with the %s storage, archive files are compressed as a whole", STORAGE_DIR)
+	}
+
+	names, err := dlManager.Storage.List(EVENTS_DIR + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events: %w", err)
+	}
+
+	var report CompressReport
+	for _, name := range names {
+		if !strings.HasSuffix(name, EVENT_EXT) {
+			continue
+		}
+		data, err := dlManager.Storage.Get(name)
+		if err != nil {
+			return &report, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		compressed, err := gzipBytes(data)
+		if err != nil {
+			return &report, fmt.Errorf("failed to compress %s: %w", name, err)
+		}
+		compressedName := name + ".gz"
+		err = dlManager.Storage.Put(compressedName, compressed)
+		if err != nil {
+			return &report, fmt.Errorf("failed to write %s: %w", compressedName, err)
+		}
+		check, err := dlManager.readEventPage(compressedName)
+		if err == nil && !bytes.Equal(check, data) {
+			err = fmt.Errorf("content differs from %s", name)
+		}
+		if err != nil {
+			dlManager.Storage.Delete(compressedName)
+			return &report, fmt.Errorf("failed to check %s: %w", compressedName, err)
+		}
+		err = dlManager.Storage.Delete(name)
+		if err != nil {
+			return &report, fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+		report.Compressed++
+		report.Before += int64(len(data))
+		report.After += int64(len(compressed))
+	}
+	return &report, nil
+}
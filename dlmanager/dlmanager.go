@@ -1,47 +1,91 @@
 package dlmanager
 
 import (
+	"XDMArchiver/hls"
 	"XDMArchiver/logger"
 	"XDMArchiver/twitter"
 	"XDMArchiver/utils"
+	"XDMArchiver/validator"
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type MediaUnit struct {
-	URL       string
-	Filename  string
-	MediaType string
+	URL              string `json:"url"`
+	Filename         string `json:"filename"`
+	MediaType        string `json:"media_type"`
+	MediaId          string `json:"media_id,omitempty"`
+	MessageId        string `json:"message_id,omitempty"`
+	MessageTime      string `json:"message_time,omitempty"`
+	SenderId         string `json:"sender_id,omitempty"`
+	SenderScreenName string `json:"sender_screen_name,omitempty"`
+	Bitrate          int    `json:"bitrate,omitempty"`
+	// ContentType is the type of the video variant, application/x-mpegURL for
+	// HLS playlists.
+	ContentType string `json:"content_type,omitempty"`
+	// DurationMs is the length of voice messages, when known.
+	DurationMs int `json:"duration_ms,omitempty"`
 }
 
 type Options struct {
 	IsDebug        bool
 	DownloadVideos bool
 	DownloadPhotos bool
+	DownloadGifs   bool
+	// DownloadSharedMedia downloads the media of shared tweets and the
+	// thumbnails of link cards.
+	DownloadSharedMedia bool
+	DownloadVoice       bool
+	OutputDir           string
+	MediaTemplate       *MediaTemplate
+	VideoQuality        *VideoQuality
+	Location            *time.Location
+	Dedup               bool
+	Storage             string
+	Encrypt             bool
+	Passphrase          string
+	KeyFile             string
+	CompressEvents      bool
 }
 
 type DLManager struct {
-	TwitterCtx     twitter.TwitterContext
-	ConversationId string
-	EventsPath     string
-	PhotosPath     string
-	VideosPath     string
-	MaxEntryId     *string
-	CurrentEvent   *twitter.ConversationResponse
-	Events         []twitter.ConversationResponse
-	Entries        []twitter.Entry
+	TwitterCtx       twitter.TwitterContext
+	ConversationId   string
+	ConversationPath string
+	Lock             *ConversationLock
+	Failures         *FailureLedger
+	Manifest         *Manifest
+	Index            *EventIndex
+	Storage          Storage
+	PhotosPath       string
+	VideosPath       string
+	MaxEntryId       *string
+	CurrentEvent     *twitter.ConversationResponse
+	Timeline         *Timeline
+	Events           []twitter.ConversationResponse
+	Entries          []twitter.Entry
+	Users            map[string]twitter.User
+	Edits            map[string][]EditRecord
+	Tombstones       map[string]Tombstone
+	// Deletions are the tombstones added during this run.
+	Deletions      []Tombstone
 	EntriesContMap map[string]string
 	MediaURLsQueue chan MediaUnit
+	PendingMedia   []MediaUnit
 	Options        Options
 }
 
@@ -50,120 +94,216 @@ const (
 	EVENTS_DIR = "events"
 	PHOTOS_DIR = "photos"
 	VIDEOS_DIR = "videos"
-	AT_END     = "AT_END"
+	GIFS_DIR   = "gifs"
+	SHARED_DIR = "shared"
+	VOICE_DIR  = "voice"
+	// CARD_MEDIA_ID names the thumbnail of a link card, which has no media id.
+	CARD_MEDIA_ID = "card"
+	AT_END        = "AT_END"
 )
 
-func InitDLManager(ConversationId string, twitterCtx twitter.TwitterContext, options Options) (*DLManager, error) {
+// OpenDLManager locks the conversation directory and prepares the manager
+// without loading any of the archived events.
+func OpenDLManager(ConversationId string, twitterCtx twitter.TwitterContext, options Options) (*DLManager, error) {
+	if options.OutputDir == "" {
+		options.OutputDir = CONVER_DIR
+	}
+	if options.MediaTemplate == nil {
+		options.MediaTemplate = &MediaTemplate{Raw: DEFAULT_MEDIA_TEMPLATE}
+	}
+	if options.VideoQuality == nil {
+		options.VideoQuality = &VideoQuality{Policy: DEFAULT_VIDEO_QUALITY}
+	}
+	if options.Location == nil {
+		options.Location = time.UTC
+	}
+
+	conversationPath := filepath.Join(options.OutputDir, ConversationId)
+	lock, err := AcquireLock(conversationPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Storage != "" && options.Storage != STORAGE_DIR && !strings.HasPrefix(options.MediaTemplate.Raw, "{conversation}/") {
+		lock.Release()
+		return nil, fmt.Errorf("media template must start with {conversation}/ to store media in an archive file")
+	}
+	storage, err := OpenStorage(options, ConversationId, conversationPath)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	fail := func(err error) (*DLManager, error) {
+		storage.Close()
+		lock.Release()
+		return nil, err
+	}
+
+	// The bookkeeping files are sealed in the storage of encrypted archives.
+	failuresJournal, err := openJournal(options, conversationPath, storage, FAILURES_FILE)
+	if err != nil {
+		return fail(err)
+	}
+	failures, err := loadFailureLedger(failuresJournal)
+	if err != nil {
+		return fail(err)
+	}
+
+	manifestJournal, err := openJournal(options, conversationPath, storage, MANIFEST_FILE)
+	if err != nil {
+		return fail(err)
+	}
+	manifest, err := loadManifest(manifestJournal)
+	if err != nil {
+		return fail(err)
+	}
+
+	indexJournal, err := openJournal(options, conversationPath, storage, INDEX_FILE)
+	if err != nil {
+		return fail(err)
+	}
+	index, err := loadEventIndex(indexJournal)
+	if err != nil {
+		return fail(err)
+	}
+
 	queue := make(chan MediaUnit, 256)
 	dlManager := DLManager{
-		TwitterCtx:     twitterCtx,
-		ConversationId: ConversationId,
-		MaxEntryId:     nil,
-		CurrentEvent:   nil,
-		MediaURLsQueue: queue,
-		Options:        options,
-		EventsPath:     filepath.Join(CONVER_DIR, ConversationId, EVENTS_DIR),
-		PhotosPath:     filepath.Join(CONVER_DIR, ConversationId, PHOTOS_DIR),
-		VideosPath:     filepath.Join(CONVER_DIR, ConversationId, VIDEOS_DIR),
-		Events:         nil,
-		Entries:        nil,
-		EntriesContMap: nil,
+		TwitterCtx:       twitterCtx,
+		ConversationId:   ConversationId,
+		ConversationPath: conversationPath,
+		Lock:             lock,
+		Failures:         failures,
+		Manifest:         manifest,
+		Index:            index,
+		Storage:          storage,
+		MaxEntryId:       nil,
+		CurrentEvent:     nil,
+		MediaURLsQueue:   queue,
+		Options:          options,
+		PhotosPath:       filepath.Join(conversationPath, PHOTOS_DIR),
+		VideosPath:       filepath.Join(conversationPath, VIDEOS_DIR),
+		Timeline:         nil,
+		Events:           nil,
+		Entries:          nil,
+		EntriesContMap:   nil,
 	}
 
-	err := dlManager.loadEvents()
+	return &dlManager, nil
+}
+
+func InitDLManager(ConversationId string, twitterCtx twitter.TwitterContext, options Options) (*DLManager, error) {
+	dlManager, err := OpenDLManager(ConversationId, twitterCtx, options)
 	if err != nil {
 		return nil, err
 	}
 
-	err = dlManager.loadEntriesFromEvents()
+	err = dlManager.syncIndex()
 	if err != nil {
+		dlManager.Close()
 		return nil, err
 	}
+	dlManager.loadFromIndex()
 
-	logger.EventsLogger.Printf("Total loaded events: %d\n", len(dlManager.Events))
-	logger.EventsLogger.Printf("Total loaded entries: %d\n", len(dlManager.Entries))
-	logger.EventsLogger.Printf("URLs to be downloaded: %d\n", len(dlManager.MediaURLsQueue))
+	logger.EventsLogger.Printf("Total indexed entries: %d\n", dlManager.Index.Count())
+	logger.EventsLogger.Printf("URLs to be downloaded: %d\n", len(dlManager.PendingMedia))
 
-	return &dlManager, nil
+	return dlManager, nil
+}
+
+// LoadEntries reads every archived entry into Events and Entries, which
+// archiving itself does not need since it works from the index.
+func (dlManager *DLManager) LoadEntries() error {
+	err := dlManager.loadEvents()
+	if err != nil {
+		return err
+	}
+	dlManager.Edits, err = dlManager.loadEdits()
+	if err != nil {
+		return err
+	}
+	dlManager.Tombstones, err = dlManager.loadTombstones()
+	if err != nil {
+		return err
+	}
+	return dlManager.loadEntriesFromEvents()
 }
 
 func (dlManager *DLManager) loadEvents() error {
-	files, err := os.ReadDir(dlManager.EventsPath)
+	timeline, err := dlManager.loadTimeline()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		} else {
-			return fmt.Errorf("failed to load events from dir %s", dlManager.EventsPath)
-		}
+		return err
 	}
+	if timeline != nil {
+		logger.EventsLogger.Printf("\tLoaded %d entries from %s\n", len(timeline.Entries), timeline.Name)
+	}
+	dlManager.Timeline = timeline
 
-	events := make([]twitter.ConversationResponse, 0, len(files))
-	for _, file := range files {
-		eventPath := filepath.Join(dlManager.EventsPath, file.Name())
-		eventFile, err := os.Open(eventPath)
-		if err != nil {
-			return fmt.Errorf("failed to load events from file %s", eventPath)
+	names, err := dlManager.eventPageNames()
+	if err != nil {
+		return err
+	}
+
+	events := make([]twitter.ConversationResponse, 0, len(names))
+	for _, name := range names {
+		if timeline.covers(name, dlManager.Index.PageSavedAt(name)) {
+			continue
 		}
-		var event twitter.ConversationResponse
-		err = json.NewDecoder(eventFile).Decode(&event)
+		event, err := dlManager.readEvent(name)
 		if err != nil {
-			return fmt.Errorf("failed to json decode from file %s", eventPath)
+			return err
 		}
-		logger.EventsLogger.Printf("\tLoaded events from %s\n", file)
-		dlManager.extractUrlsFromEvent(event)
-		events = append(events, event)
+		logger.EventsLogger.Printf("\tLoaded events from %s\n", name)
+		events = append(events, *event)
 	}
 
 	dlManager.Events = events
 	return nil
 }
 
+func (dlManager *DLManager) readEvent(name string) (*twitter.ConversationResponse, error) {
+	data, err := dlManager.readEventPage(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load events from file %s: %w", name, err)
+	}
+	var event twitter.ConversationResponse
+	err = json.Unmarshal(data, &event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to json decode from file %s: %w", name, err)
+	}
+	event.Raw = data
+	return &event, nil
+}
+
+// loadEntriesFromEvents merges the entries of the timeline, the loaded pages
+// and the tombstones, keeping one copy of every message, oldest first.
 func (dlManager *DLManager) loadEntriesFromEvents() error {
-	entries := make([]twitter.Entry, 0)
-	entriesContMap := make(map[string]string)
+	collector := newEntryCollector()
+	if dlManager.Timeline != nil {
+		collector.addTimeline(dlManager.Timeline)
+	}
 	for _, event := range dlManager.Events {
-		eventEntries := event.GetEntries()
-		for i := range eventEntries {
-			entries = append(entries, eventEntries[i])
-
-			nextEntryTimestamp := ""
-			if i+1 < len(eventEntries) {
-				nextEntryTimestamp = eventEntries[i+1].Message.Time
-			}
-			if eventEntries[i].Message.Time == nextEntryTimestamp {
-				logger.EventsLogger.Fatalf("Found a loop in the contiuation map with id %s\n", nextEntryTimestamp)
-			}
-			val, isSet := entriesContMap[eventEntries[i].Message.Time]
-			if (isSet && val == "") || !isSet {
-				entriesContMap[eventEntries[i].Message.Time] = nextEntryTimestamp
-			}
-		}
+		collector.addEvent("", event)
 	}
-
-	sort.Slice(entries, func(i, j int) bool {
-		timeA, err := strconv.ParseInt(entries[i].Message.Time, 10, 64)
-		if err != nil {
-			logger.EventsLogger.Fatalf("Invalid timestamp when sorting the entries %s.", entries[i].Message.Time)
+	// A deleted message is only left in its tombstone once its page was saved
+	// again.
+	for _, tombstone := range dlManager.Tombstones {
+		if tombstone.Entry != nil {
+			collector.add(tombstone.Page, *tombstone.Entry, "")
 		}
-		timeB, err := strconv.ParseInt(entries[j].Message.Time, 10, 64)
-		if err != nil {
-			logger.EventsLogger.Fatalf("Invalid timestamp when sorting the entries %s.", entries[i].Message.Time)
-		}
-		return time.UnixMilli(timeA).Before(time.UnixMilli(timeB))
-	})
+	}
+	collector.sort()
+	attachReactions(collector.Entries)
+	resolveReplies(collector.Entries)
 
-	dlManager.Entries = entries
-	dlManager.EntriesContMap = entriesContMap
+	dlManager.Entries = collector.Entries
+	dlManager.Users = collector.Users
+	dlManager.EntriesContMap = collector.ContMap
 
 	return nil
 }
 
 func (dlManager *DLManager) saveCurrentEvent() error {
-	err := os.MkdirAll(dlManager.EventsPath, 0755)
-	if err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
 	var maxId string
 	if dlManager.MaxEntryId != nil {
 		maxId = *dlManager.MaxEntryId
@@ -172,19 +312,48 @@ func (dlManager *DLManager) saveCurrentEvent() error {
 		maxId = maxEntry.GetEntryId()
 	}
 
-	eventPath := filepath.Join(dlManager.EventsPath, maxId+".json")
-	file, err := os.Create(eventPath)
+	eventName := eventPageName(maxId, dlManager.Options.CompressEvents)
+	// The page is the response as received, so fields that are not modeled yet
+	// are kept. Events that were not received from the API are encoded.
+	data := dlManager.CurrentEvent.Raw
+	if len(data) == 0 {
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetIndent("", "\t")
+		if err := encoder.Encode(dlManager.CurrentEvent); err != nil {
+			return fmt.Errorf("failed to encode conversation: %w", err)
+		}
+		data = buffer.Bytes()
+	}
+	err := dlManager.recordEdits(*dlManager.CurrentEvent)
 	if err != nil {
-		return fmt.Errorf("failed to create event file: %w", err)
+		return err
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "\t")
-	if err := encoder.Encode(dlManager.CurrentEvent); err != nil {
-		return fmt.Errorf("failed to encode conversation: %w", err)
+	err = dlManager.detectDeletions(*dlManager.CurrentEvent)
+	if err != nil {
+		return err
 	}
-	logger.EventsLogger.Printf("\tSuccessfully saved event: %s", eventPath)
+	if dlManager.Options.CompressEvents {
+		compressed, err := gzipBytes(data)
+		if err != nil {
+			return fmt.Errorf("failed to compress conversation: %w", err)
+		}
+		data = compressed
+	}
+	err = dlManager.Storage.Put(eventName, data)
+	if err != nil {
+		return fmt.Errorf("failed to save event file: %w", err)
+	}
+	err = dlManager.Index.AddPage(eventName, *dlManager.CurrentEvent, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	// A page saved earlier with the other compression setting is outdated now.
+	otherName := eventPageName(maxId, !dlManager.Options.CompressEvents)
+	if canDelete(dlManager.Storage) && dlManager.Storage.Exists(otherName) {
+		dlManager.Storage.Delete(otherName)
+	}
+	logger.EventsLogger.Printf("\tSuccessfully saved event: %s", eventName)
 
 	return nil
 }
@@ -199,6 +368,9 @@ func (dlManager *DLManager) printStats() {
 		logger.EventsLogger.Print("\tResult for max_entry_id: nil\n")
 	}
 	logger.EventsLogger.Printf("\tEvents count %d\n", len(entries))
+	if system := countEntries(dlManager.CurrentEvent.GetTimelineEntries()); len(system) > 0 {
+		logger.EventsLogger.Printf("\tConversation events %v\n", system)
+	}
 	if err != nil {
 		logger.EventsLogger.Printf("\tOldest Message Date & Time: %v\n", err)
 	} else {
@@ -247,44 +419,203 @@ func (dlManager *DLManager) setNextMaxEntryId() {
 	dlManager.MaxEntryId = &newMaxEntry
 }
 
-func (dlManager *DLManager) extractUrlsFromEvent(event twitter.ConversationResponse) {
-	urls := make([]MediaUnit, 0, 10)
-	for _, entry := range event.GetEntries() {
-		if entry.Message.MessageData.Attachment != nil {
-			stamp, _ := utils.FormatUnixTimestamp(entry.Message.MessageData.Time, true)
-			if dlManager.Options.DownloadVideos {
-				vars := entry.Message.MessageData.Attachment.Video.VideoInfo.Variants
-				sort.Slice(vars, func(i, j int) bool {
-					return vars[i].Bitrate > vars[j].Bitrate
-				})
-				for _, v := range vars {
-					if v.ContentType == "video/mp4" {
-						urls = append(urls, MediaUnit{
-							URL:       v.URL,
-							Filename:  fmt.Sprintf("%s-%d.mp4", stamp, v.Bitrate),
-							MediaType: "Video",
-						})
-						break
-					}
-				}
+// mediaUnitsFromEntry lists every downloadable media of a message regardless
+// of the download options, with every variant of the videos.
+func mediaUnitsFromEntry(entry twitter.Entry, users map[string]twitter.User) []MediaUnit {
+	units := make([]MediaUnit, 0, 2)
+	if entry.Message == nil || entry.Message.MessageData.Attachment == nil {
+		return units
+	}
+	messageId := entry.GetMessageId()
+	messageTime := entry.Message.MessageData.Time
+	senderId := entry.Message.MessageData.SenderID
+	senderScreenName := users[senderId].ScreenName
+	attachment := entry.Message.MessageData.Attachment
+
+	addVideo := func(video twitter.Video, mediaType string) {
+		vars := video.VideoInfo.Variants
+		sort.Slice(vars, func(i, j int) bool {
+			return vars[i].Bitrate > vars[j].Bitrate
+		})
+		base := MediaUnit{
+			MediaType:        mediaType,
+			MediaId:          video.IDStr,
+			MessageId:        messageId,
+			MessageTime:      messageTime,
+			SenderId:         senderId,
+			SenderScreenName: senderScreenName,
+		}
+		if mediaType == "Voice" {
+			base.DurationMs = video.DurationMs()
+		}
+		// GIFs have a single variant, without a bitrate, and voice messages
+		// are named after the message alone. Other videos list every variant
+		// for the video quality to pick from.
+		single := mediaType == "Gif" || mediaType == "Voice" || video.Type == twitter.MEDIA_ANIMATED_GIF
+		found := false
+		for _, v := range vars {
+			ext := "mp4"
+			if v.ContentType == "audio/mp4" && mediaType == "Voice" {
+				ext = "m4a"
+			} else if v.ContentType != "video/mp4" {
+				continue
+			}
+			suffix := strconv.Itoa(v.Bitrate)
+			if single {
+				suffix = ""
+			}
+			unit := base
+			unit.URL = v.URL
+			unit.Filename = mediaFilename(messageId, video.IDStr, suffix, ext)
+			unit.ContentType = v.ContentType
+			unit.Bitrate = v.Bitrate
+			units = append(units, unit)
+			found = true
+			if single {
+				break
 			}
+		}
+		// The HLS playlist is only used for videos without an mp4 variant.
+		if found {
+			return
+		}
+		for _, v := range vars {
+			if strings.EqualFold(v.ContentType, hls.CONTENT_TYPE) {
+				unit := base
+				unit.URL = v.URL
+				unit.Filename = mediaFilename(messageId, video.IDStr, "", hlsExtension(v.URL))
+				unit.ContentType = v.ContentType
+				units = append(units, unit)
+				break
+			}
+		}
+	}
+	if attachment.Video.IsVoice() {
+		addVideo(attachment.Video, "Voice")
+	} else if attachment.Video.Type == twitter.MEDIA_ANIMATED_GIF {
+		addVideo(attachment.Video, "Gif")
+	} else {
+		addVideo(attachment.Video, "Video")
+	}
+	addVideo(attachment.AnimatedGif, "Gif")
 
-			if dlManager.Options.DownloadPhotos {
-				photoUrl := entry.Message.MessageData.Attachment.Photo.MediaURLHTTPS
-				if photoUrl != "" {
-					urls = append(urls, MediaUnit{
-						URL:       photoUrl,
-						Filename:  fmt.Sprintf("%s.jpg\n", stamp),
-						MediaType: "Photo",
-					})
-				}
+	addPhoto := func(photoUrl string, mediaId string, mediaType string) {
+		if photoUrl == "" {
+			return
+		}
+		units = append(units, MediaUnit{
+			URL:              photoUrl,
+			Filename:         mediaFilename(messageId, mediaId, "", photoExtension(photoUrl)),
+			MediaType:        mediaType,
+			MediaId:          mediaId,
+			MessageId:        messageId,
+			MessageTime:      messageTime,
+			SenderId:         senderId,
+			SenderScreenName: senderScreenName,
+		})
+	}
+	addPhoto(attachment.Photo.MediaURLHTTPS, attachment.Photo.IDStr, "Photo")
+
+	// The media of shared tweets and the thumbnails of link cards.
+	if attachment.Tweet != nil && attachment.Tweet.Status != nil {
+		for _, media := range attachment.Tweet.Status.GetMedia() {
+			if media.Type == "photo" {
+				addPhoto(media.MediaURLHTTPS, media.IDStr, "Shared")
+			} else {
+				addVideo(media, "Shared")
 			}
 		}
 	}
+	if attachment.Card != nil {
+		addPhoto(attachment.Card.ThumbnailURL(), CARD_MEDIA_ID, "Shared")
+	}
+
+	return units
+}
+
+// mediaFilename builds a file name out of the message and media ids, which is
+// unique within a conversation and only uses characters that are valid on
+// every common filesystem.
+func mediaFilename(messageId string, mediaId string, suffix string, ext string) string {
+	parts := make([]string, 0, 3)
+	for _, part := range []string{messageId, mediaId, suffix} {
+		if part != "" {
+			parts = append(parts, sanitizeFilenamePart(part))
+		}
+	}
+	return strings.Join(parts, "_") + "." + ext
+}
+
+func sanitizeFilenamePart(part string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '-' {
+			return r
+		}
+		return '-'
+	}, part)
+}
+
+// photoExtension returns the extension of the photo in its URL, falling back
+// to jpg for anything unexpected.
+func photoExtension(photoUrl string) string {
+	parsed, err := url.Parse(photoUrl)
+	if err != nil {
+		return "jpg"
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(parsed.Path), "."))
+	// Card images have no extension, only a format parameter.
+	if ext == "" {
+		ext = strings.ToLower(parsed.Query().Get("format"))
+	}
+	switch ext {
+	case "jpg", "jpeg", "png", "gif", "webp":
+		return ext
+	}
+	return "jpg"
+}
+
+// hlsExtension returns the extension of the file an HLS playlist is joined
+// into. X marks the playlists of fragmented MP4 segments with a container
+// parameter, the others have MPEG-TS segments.
+func hlsExtension(playlistUrl string) string {
+	parsed, err := url.Parse(playlistUrl)
+	if err != nil {
+		return "ts"
+	}
+	switch strings.ToLower(parsed.Query().Get("container")) {
+	case "fmp4", "cmaf":
+		return "mp4"
+	}
+	return "ts"
+}
 
-	for _, url := range urls {
-		dlManager.MediaURLsQueue <- url
+func (dlManager *DLManager) isMediaTypeEnabled(mediaType string) bool {
+	switch mediaType {
+	case "Video":
+		return dlManager.Options.DownloadVideos
+	case "Photo":
+		return dlManager.Options.DownloadPhotos
+	case "Gif":
+		return dlManager.Options.DownloadGifs
+	case "Shared":
+		return dlManager.Options.DownloadSharedMedia
+	case "Voice":
+		return dlManager.Options.DownloadVoice
 	}
+	return false
+}
+
+func (dlManager *DLManager) extractUrlsFromEvent(event twitter.ConversationResponse) []MediaUnit {
+	urls := make([]MediaUnit, 0, 10)
+	for _, entry := range event.GetEntries() {
+		for _, unit := range dlManager.selectMedia(mediaUnitsFromEntry(entry, event.ConversationTimeline.Users)) {
+			if dlManager.isMediaTypeEnabled(unit.MediaType) {
+				urls = append(urls, unit)
+			}
+		}
+	}
+
+	return urls
 }
 
 func (dlManager *DLManager) downloadEvents() {
@@ -321,8 +652,14 @@ func (dlManager *DLManager) downloadEvents() {
 		}
 		dlManager.CurrentEvent = event
 		dlManager.setNextMaxEntryId()
-		dlManager.extractUrlsFromEvent(*event)
-		dlManager.saveCurrentEvent()
+		for _, url := range dlManager.extractUrlsFromEvent(*event) {
+			dlManager.MediaURLsQueue <- url
+		}
+		if err := dlManager.saveCurrentEvent(); err != nil {
+			// The next page starts after this one, so it cannot be skipped.
+			logger.EventsLogger.Printf("Error while saving conversation: %s\n", err)
+			break
+		}
 		dlManager.printStats()
 		logger.EventsLogger.Printf("\tNext max entry is %s\n", *dlManager.MaxEntryId)
 		logger.EventsLogger.Printf("\tNext max entry timestamp is %d\n", twitter.DecodeSnowflake(*dlManager.MaxEntryId).Timestamp.UnixMilli())
@@ -332,44 +669,25 @@ func (dlManager *DLManager) downloadEvents() {
 			break
 		}
 	}
-
-	close(dlManager.MediaURLsQueue)
 }
 
-func (dlManager *DLManager) downloadMedia() {
-	err := os.MkdirAll(dlManager.PhotosPath, 0755)
+// mediaName returns the storage name of a media unit: the path given by the
+// media template, made relative to the conversation directory.
+func (dlManager *DLManager) mediaName(unit MediaUnit) string {
+	rendered := dlManager.Options.MediaTemplate.Render(dlManager.ConversationId, unit, dlManager.Options.Location)
+	full := filepath.Join(dlManager.Options.OutputDir, filepath.FromSlash(rendered))
+	relative, err := filepath.Rel(dlManager.ConversationPath, full)
 	if err != nil {
-		logger.MediaLogger.Fatalf("failed to create directory: %+v\n", err)
-	}
-	err = os.MkdirAll(dlManager.VideosPath, 0755)
-	if err != nil {
-		logger.MediaLogger.Fatalf("failed to create directory: %+v\n", err)
+		return rendered
 	}
+	return filepath.ToSlash(relative)
+}
+
+func (dlManager *DLManager) downloadMedia() {
 	for {
 		unit, ok := <-dlManager.MediaURLsQueue
 		if ok {
-			var path string
-			if unit.MediaType == "Photo" {
-				path = filepath.Join(dlManager.PhotosPath, unit.Filename)
-			} else {
-				path = filepath.Join(dlManager.VideosPath, unit.Filename)
-			}
-			if utils.FileExists(path) {
-				logger.MediaLogger.Printf("File %s exists. Skipping\n", unit.Filename)
-				continue
-			}
-			logger.MediaLogger.Printf("Downloading URL: %s\n", unit.URL)
-			bytes, err := dlManager.TwitterCtx.GetFile(unit.URL)
-			if err != nil {
-				logger.MediaLogger.Printf("Failed to download url %s: %+v\n", unit.URL, err)
-				continue
-			}
-			err = os.WriteFile(path, bytes, 0644)
-			if err != nil {
-				logger.MediaLogger.Printf("Failed to write file %s to FS: %+v\n", unit.Filename, err)
-			} else {
-				logger.MediaLogger.Printf("Downloaded %s successfully\n", unit.Filename)
-			}
+			dlManager.downloadUnit(unit)
 		} else {
 			logger.MediaLogger.Printf("Done downloading")
 			return
@@ -377,11 +695,179 @@ func (dlManager *DLManager) downloadMedia() {
 	}
 }
 
+func (dlManager *DLManager) downloadUnit(unit MediaUnit) {
+	name := dlManager.mediaName(unit)
+	if dlManager.Storage.Exists(name) {
+		existing, err := dlManager.Storage.Get(name)
+		if err == nil {
+			err = validator.Validate(unit.Filename, existing)
+		}
+		if err == nil {
+			logger.MediaLogger.Printf("File %s exists. Skipping\n", unit.Filename)
+			dlManager.resolveFailure(unit)
+			if _, ok := dlManager.Manifest.Get(name); !ok {
+				dlManager.addToManifest(unit, name, existing, nil)
+			}
+			return
+		}
+		logger.MediaLogger.Printf("File %s exists but is corrupt (%v). Downloading again\n", unit.Filename, err)
+	}
+	logger.MediaLogger.Printf("Downloading URL: %s\n", unit.URL)
+	bytes, stream, err := dlManager.getMedia(unit)
+	if err != nil && isExpiredMediaError(err) && unit.MessageId != "" {
+		logger.MediaLogger.Printf("URL of %s looks expired (%v), refreshing it from message %s\n", unit.Filename, err, unit.MessageId)
+		fresh, refreshErr := dlManager.refreshMediaUnit(unit)
+		if refreshErr != nil {
+			logger.MediaLogger.Printf("Failed to refresh url of %s: %v\n", unit.Filename, refreshErr)
+		} else {
+			if fresh.Filename != unit.Filename {
+				dlManager.resolveFailure(unit)
+			}
+			unit = *fresh
+			name = dlManager.mediaName(unit)
+			logger.MediaLogger.Printf("Downloading refreshed URL: %s\n", unit.URL)
+			bytes, stream, err = dlManager.getMedia(unit)
+		}
+	}
+	if err != nil {
+		logger.MediaLogger.Printf("Failed to download url %s: %+v\n", unit.URL, err)
+		var statusError *twitter.ErrNot200
+		if errors.As(err, &statusError) {
+			dlManager.recordFailure(unit, ERROR_CLASS_HTTP, err)
+		} else if errors.Is(err, errInvalidPlaylist) {
+			dlManager.recordFailure(unit, ERROR_CLASS_INVALID, err)
+		} else if errors.Is(err, errUnsupportedPlaylist) {
+			dlManager.recordFailure(unit, ERROR_CLASS_UNSUPPORTED, err)
+		} else {
+			dlManager.recordFailure(unit, ERROR_CLASS_NETWORK, err)
+		}
+		return
+	}
+	err = validator.Validate(unit.Filename, bytes)
+	if err != nil {
+		logger.MediaLogger.Printf("Downloaded %s is not valid media: %v\n", unit.Filename, err)
+		dlManager.recordFailure(unit, ERROR_CLASS_INVALID, err)
+		return
+	}
+	err = dlManager.putMedia(name, bytes)
+	if err != nil {
+		logger.MediaLogger.Printf("Failed to write file %s to FS: %+v\n", unit.Filename, err)
+		dlManager.recordFailure(unit, ERROR_CLASS_WRITE, err)
+		return
+	}
+	logger.MediaLogger.Printf("Downloaded %s successfully\n", unit.Filename)
+	dlManager.resolveFailure(unit)
+	dlManager.addToManifest(unit, name, bytes, stream)
+}
+
+// putMedia stores a downloaded media file, deduplicated when the storage
+// supports it.
+func (dlManager *DLManager) putMedia(name string, data []byte) error {
+	if dirStorage, ok := dlManager.Storage.(*DirStorage); ok {
+		return dirStorage.PutMedia(name, data)
+	}
+	return dlManager.Storage.Put(name, data)
+}
+
+// addToManifest records a downloaded file, with the variant picked for videos
+// and the stream it was joined from for HLS playlists, unknown for files found
+// on disk.
+func (dlManager *DLManager) addToManifest(unit MediaUnit, name string, data []byte, stream *hlsStream) {
+	record := ManifestRecord{
+		MessageId:    unit.MessageId,
+		SenderId:     unit.SenderId,
+		MediaType:    unit.MediaType,
+		SourceURL:    unit.URL,
+		Bitrate:      unit.Bitrate,
+		DurationMs:   unit.DurationMs,
+		ContentType:  unit.ContentType,
+		Path:         name,
+		Size:         int64(len(data)),
+		SHA256:       sha256Hex(data),
+		DownloadedAt: time.Now(),
+	}
+	if unit.ContentType != "" {
+		record.VideoQuality = dlManager.Options.VideoQuality.String()
+	}
+	if stream != nil {
+		record.Bitrate = stream.Variant.Bandwidth
+		record.StreamURL = stream.Variant.URL
+		record.Resolution = stream.Variant.Resolution
+		record.Segments = stream.Segments
+	}
+	err := dlManager.Manifest.Add(record)
+	if err != nil {
+		logger.MediaLogger.Printf("Failed to add %s to the manifest: %v\n", unit.Filename, err)
+	}
+}
+
+func (dlManager *DLManager) recordFailure(unit MediaUnit, errorClass string, cause error) {
+	err := dlManager.Failures.Record(unit, errorClass, cause)
+	if err != nil {
+		logger.MediaLogger.Printf("Failed to record download failure of %s: %v\n", unit.Filename, err)
+	}
+}
+
+func (dlManager *DLManager) resolveFailure(unit MediaUnit) {
+	err := dlManager.Failures.Resolve(unit)
+	if err != nil {
+		logger.MediaLogger.Printf("Failed to clear download failure of %s: %v\n", unit.Filename, err)
+	}
+}
+
+// RetryFailed re-attempts the downloads recorded in the failures ledger, except
+// the unsupported ones, and returns how many of them are still failing.
+func (dlManager *DLManager) RetryFailed() int {
+	failures := dlManager.Failures.Failures()
+	units := make([]MediaUnit, 0, len(failures))
+	for _, failure := range failures {
+		if failure.ErrorClass == ERROR_CLASS_UNSUPPORTED {
+			continue
+		}
+		units = append(units, failure.MediaUnit)
+	}
+	logger.MediaLogger.Printf("Retrying %d failed downloads, skipping %d unsupported ones\n", len(units), len(failures)-len(units))
+	dlManager.downloadUnits(units)
+
+	remaining := 0
+	for _, unit := range units {
+		if dlManager.Failures.Has(unit) {
+			remaining++
+		}
+	}
+	logger.MediaLogger.Printf("Recovered %d of %d failed downloads\n", len(units)-remaining, len(units))
+	return remaining
+}
+
+// downloadUnits downloads the given media only, without fetching any events.
+func (dlManager *DLManager) downloadUnits(units []MediaUnit) {
+	go func() {
+		for _, unit := range units {
+			dlManager.MediaURLsQueue <- unit
+		}
+		close(dlManager.MediaURLsQueue)
+	}()
+	dlManager.downloadMedia()
+}
+
 func (dlManager *DLManager) Start() {
 	var wg sync.WaitGroup
+	var producers sync.WaitGroup
+	producers.Add(2)
 	wg.Add(2)
+	go func() {
+		for _, unit := range dlManager.PendingMedia {
+			dlManager.MediaURLsQueue <- unit
+		}
+		producers.Done()
+	}()
 	go func() {
 		dlManager.downloadEvents()
+		producers.Done()
+	}()
+	go func() {
+		producers.Wait()
+		close(dlManager.MediaURLsQueue)
 		wg.Done()
 	}()
 	go func() {
@@ -389,4 +875,20 @@ func (dlManager *DLManager) Start() {
 		wg.Done()
 	}()
 	wg.Wait()
+	dlManager.printDeletions()
+}
+
+func (dlManager *DLManager) Close() {
+	if dlManager.Lock == nil {
+		return
+	}
+	err := dlManager.Storage.Close()
+	if err != nil {
+		logger.EventsLogger.Printf("Failed to close storage: %v\n", err)
+	}
+	err = dlManager.Lock.Release()
+	if err != nil {
+		logger.EventsLogger.Printf("Failed to release conversation lock: %v\n", err)
+	}
+	dlManager.Lock = nil
 }
@@ -0,0 +1,162 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/twitter"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	EDITS_DIR = "edits"
+)
+
+// EditRecord is a version of a message that was replaced by an edit, found by
+// comparing a page with the version archived before. It is stored in the
+// storage of the conversation, as edits/{message_id}_{seen_at}.json, so it is
+// encrypted along with the events.
+type EditRecord struct {
+	MessageId string `json:"message_id"`
+	Text      string `json:"text"`
+	// Time is the time the message was sent, EditedAt the time of the edit that
+	// replaced this version when the API tells it.
+	Time     string    `json:"time"`
+	EditedAt string    `json:"edited_at,omitempty"`
+	Page     string    `json:"page"`
+	SeenAt   time.Time `json:"seen_at"`
+}
+
+// loadEdits reads the recorded versions of the edited messages, oldest first.
+func (dlManager *DLManager) loadEdits() (map[string][]EditRecord, error) {
+	names, err := dlManager.Storage.List(EDITS_DIR + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list edits: %w", err)
+	}
+	edits := make(map[string][]EditRecord)
+	for _, name := range names {
+		data, err := dlManager.Storage.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read edit %s: %w", name, err)
+		}
+		var record EditRecord
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to json decode edit %s: %w", name, err)
+		}
+		edits[record.MessageId] = append(edits[record.MessageId], record)
+	}
+	for _, records := range edits {
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].SeenAt.Before(records[j].SeenAt)
+		})
+	}
+	return edits, nil
+}
+
+// recordEdits compares the messages of a page about to be saved with the
+// versions archived before, and records every version whose text changed. It
+// must run before the page is saved, since it may replace the archived one.
+func (dlManager *DLManager) recordEdits(event twitter.ConversationResponse) error {
+	byPage := make(map[string][]twitter.Entry)
+	for _, entry := range event.GetEntries() {
+		record, ok := dlManager.Index.Lookup(entryKey(entry))
+		if ok {
+			byPage[record.Page] = append(byPage[record.Page], entry)
+		}
+	}
+	if len(byPage) == 0 {
+		return nil
+	}
+
+	if dlManager.Edits == nil {
+		edits, err := dlManager.loadEdits()
+		if err != nil {
+			return err
+		}
+		dlManager.Edits = edits
+	}
+
+	pages := make([]string, 0, len(byPage))
+	for page := range byPage {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+	for _, page := range pages {
+		name := dlManager.storedPageName(page)
+		if !dlManager.Storage.Exists(name) {
+			continue
+		}
+		archived, err := dlManager.readEvent(name)
+		if err != nil {
+			return err
+		}
+		previous := make(map[string]twitter.Entry)
+		for _, entry := range archived.GetEntries() {
+			previous[entryKey(entry)] = entry
+		}
+		for _, entry := range byPage[page] {
+			old, ok := previous[entryKey(entry)]
+			if !ok || old.Message.MessageData.Text == entry.Message.MessageData.Text {
+				continue
+			}
+			err = dlManager.recordEdit(EditRecord{
+				MessageId: entryKey(entry),
+				Text:      old.Message.MessageData.Text,
+				Time:      old.Message.MessageData.Time,
+				EditedAt:  string(entry.Message.MessageData.EditedAt),
+				Page:      page,
+				SeenAt:    time.Now().UTC(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (dlManager *DLManager) recordEdit(record EditRecord) error {
+	// The index may still point to the page of an older version, which would
+	// be found again on every run.
+	for _, known := range dlManager.Edits[record.MessageId] {
+		if known.Text == record.Text {
+			return nil
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode edit: %w", err)
+	}
+	name := EDITS_DIR + "/" + sanitizeFilenamePart(record.MessageId) + "_" + strconv.FormatInt(record.SeenAt.UnixNano(), 10) + ".json"
+	err = dlManager.Storage.Put(name, data)
+	if err != nil {
+		return fmt.Errorf("failed to save edit %s: %w", name, err)
+	}
+	dlManager.Edits[record.MessageId] = append(dlManager.Edits[record.MessageId], record)
+	logger.EventsLogger.Printf("\tMessage %s was edited since it was archived, kept the previous version\n", record.MessageId)
+	return nil
+}
+
+// previousVersions lists the earlier texts of a message, from the edit history
+// returned by the API and the versions recorded between runs.
+func (dlManager *DLManager) previousVersions(entry twitter.Entry) []string {
+	seen := map[string]bool{entry.Message.MessageData.Text: true}
+	versions := make([]string, 0)
+	add := func(text string) {
+		if !seen[text] {
+			seen[text] = true
+			versions = append(versions, html.UnescapeString(text))
+		}
+	}
+	for _, edit := range entry.Message.MessageData.EditHistory {
+		add(edit.Text)
+	}
+	for _, record := range dlManager.Edits[entryKey(entry)] {
+		add(record.Text)
+	}
+	return versions
+}
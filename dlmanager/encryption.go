@@ -0,0 +1,443 @@
+package dlmanager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	KEY_FILE       = "key.json"
+	SEALED_DIR     = "sealed"
+	SEALED_INDEX   = SEALED_DIR + "/index"
+	KDF_SCRYPT     = "scrypt"
+	KDF_KEY_FILE   = "key-file"
+	SCRYPT_N       = 1 << 15
+	SCRYPT_R       = 8
+	SCRYPT_P       = 1
+	MIN_KEY_LENGTH = 32
+
+	// SEALED_INDEX_CHANGES prefixes the numbered files holding the names added
+	// and removed since the index was last saved in full.
+	SEALED_INDEX_CHANGES = SEALED_INDEX + "."
+)
+
+var ErrWrongKey = errors.New("wrong passphrase or key file")
+
+// KeyParams is stored in plain text next to an encrypted archive and holds what
+// is needed to derive its key again. Check tells a wrong passphrase apart from
+// corrupt data.
+type KeyParams struct {
+	KDF   string `json:"kdf"`
+	Salt  []byte `json:"salt"`
+	N     int    `json:"n,omitempty"`
+	R     int    `json:"r,omitempty"`
+	P     int    `json:"p,omitempty"`
+	Check string `json:"check"`
+}
+
+func deriveSubkey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (params *KeyParams) deriveKey(options Options) ([]byte, error) {
+	switch params.KDF {
+	case KDF_SCRYPT:
+		if options.KeyFile != "" {
+			return nil, fmt.Errorf("the archive is encrypted with a passphrase, not a key file")
+		}
+		if options.Passphrase == "" {
+			return nil, fmt.Errorf("a passphrase is needed to open the encrypted archive")
+		}
+		return scrypt([]byte(options.Passphrase), params.Salt, params.N, params.R, params.P, 32)
+	case KDF_KEY_FILE:
+		if options.KeyFile == "" {
+			return nil, fmt.Errorf("the archive is encrypted with a key file, pass it with --key-file")
+		}
+		content, err := os.ReadFile(options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		if len(content) < MIN_KEY_LENGTH {
+			return nil, fmt.Errorf("key file %s must hold at least %d bytes", options.KeyFile, MIN_KEY_LENGTH)
+		}
+		mac := hmac.New(sha256.New, params.Salt)
+		mac.Write(content)
+		return mac.Sum(nil), nil
+	}
+	return nil, fmt.Errorf("unknown key derivation %s", params.KDF)
+}
+
+// loadArchiveKey returns the key of the encrypted conversation, creating new
+// key parameters the first time the conversation is encrypted.
+func loadArchiveKey(conversationPath string, options Options) ([]byte, error) {
+	keyPath := filepath.Join(conversationPath, KEY_FILE)
+	var params KeyParams
+	content, err := os.ReadFile(keyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", keyPath, err)
+	}
+
+	if err == nil {
+		err = json.Unmarshal(content, &params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", keyPath, err)
+		}
+		master, err := params.deriveKey(options)
+		if err != nil {
+			return nil, err
+		}
+		check := hex.EncodeToString(deriveSubkey(master, "check"))
+		if !hmac.Equal([]byte(check), []byte(params.Check)) {
+			return nil, ErrWrongKey
+		}
+		return master, nil
+	}
+
+	params.Salt = make([]byte, 16)
+	_, err = rand.Read(params.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if options.KeyFile != "" {
+		params.KDF = KDF_KEY_FILE
+	} else {
+		params.KDF = KDF_SCRYPT
+		params.N, params.R, params.P = SCRYPT_N, SCRYPT_R, SCRYPT_P
+	}
+	master, err := params.deriveKey(options)
+	if err != nil {
+		return nil, err
+	}
+	params.Check = hex.EncodeToString(deriveSubkey(master, "check"))
+
+	content, err = json.MarshalIndent(params, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(conversationPath, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = os.WriteFile(keyPath, content, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", keyPath, err)
+	}
+	return master, nil
+}
+
+// sealedIndex is the encrypted list of the stored names. Changes is the number
+// of the last changes file it includes.
+type sealedIndex struct {
+	Names   []string `json:"names"`
+	Changes int      `json:"changes"`
+}
+
+// sealedIndexChanges holds the names added and removed since the previous
+// changes file.
+type sealedIndexChanges struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// EncryptedStorage seals every file with AES-GCM before handing it to the
+// underlying storage. Files are stored under opaque names derived from their
+// real names, which are only kept in an encrypted index.
+//
+// The index is saved in full when the storage is closed. Until then, the names
+// that changed are saved in small numbered changes files, so archive files do
+// not grow with a copy of every name for each event page.
+type EncryptedStorage struct {
+	inner   Storage
+	aead    cipher.AEAD
+	nameKey []byte
+	mutex   sync.Mutex
+	names   map[string]bool
+	dirty   bool
+	pending sealedIndexChanges
+	// changes is the number of the last changes file, and changeFiles the
+	// changes files not included in the full index yet.
+	changes     int
+	changeFiles []string
+}
+
+func NewEncryptedStorage(inner Storage, master []byte) (*EncryptedStorage, error) {
+	block, err := aes.NewCipher(deriveSubkey(master, "content"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	storage := EncryptedStorage{
+		inner:   inner,
+		aead:    aead,
+		nameKey: deriveSubkey(master, "names"),
+		names:   make(map[string]bool),
+	}
+
+	err = storage.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return &storage, nil
+}
+
+// loadIndex reads the full index, then applies the changes saved after it.
+// Indexes written by older versions are a plain list of names.
+func (storage *EncryptedStorage) loadIndex() error {
+	if storage.inner.Exists(SEALED_INDEX) {
+		content, err := storage.readSealed(SEALED_INDEX)
+		if err != nil {
+			return fmt.Errorf("failed to read the encrypted index: %w", err)
+		}
+		var index sealedIndex
+		if len(content) > 0 && content[0] == '[' {
+			err = json.Unmarshal(content, &index.Names)
+		} else {
+			err = json.Unmarshal(content, &index)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse the encrypted index: %w", err)
+		}
+		for _, name := range index.Names {
+			storage.names[name] = true
+		}
+		storage.changes = index.Changes
+	}
+
+	changeFiles, err := storage.inner.List(SEALED_INDEX_CHANGES)
+	if err != nil {
+		return fmt.Errorf("failed to list the encrypted index changes: %w", err)
+	}
+	numbers := make(map[string]int, len(changeFiles))
+	for _, name := range changeFiles {
+		number, err := strconv.Atoi(strings.TrimPrefix(name, SEALED_INDEX_CHANGES))
+		if err == nil {
+			numbers[name] = number
+		}
+	}
+	sort.Slice(changeFiles, func(i, j int) bool {
+		return numbers[changeFiles[i]] < numbers[changeFiles[j]]
+	})
+	for _, name := range changeFiles {
+		number, ok := numbers[name]
+		if !ok {
+			continue
+		}
+		if number <= storage.changes {
+			// Included in the full index, left over when it could not be removed.
+			storage.changeFiles = append(storage.changeFiles, name)
+			continue
+		}
+		content, err := storage.readSealed(name)
+		if err != nil {
+			return fmt.Errorf("failed to read the encrypted index changes: %w", err)
+		}
+		var changes sealedIndexChanges
+		err = json.Unmarshal(content, &changes)
+		if err != nil {
+			return fmt.Errorf("failed to parse the encrypted index changes: %w", err)
+		}
+		for _, added := range changes.Added {
+			storage.names[added] = true
+		}
+		for _, removed := range changes.Removed {
+			delete(storage.names, removed)
+		}
+		storage.changes = number
+		storage.changeFiles = append(storage.changeFiles, name)
+		storage.dirty = true
+	}
+	return nil
+}
+
+func (storage *EncryptedStorage) readSealed(name string) ([]byte, error) {
+	sealed, err := storage.inner.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return storage.open(name, sealed)
+}
+
+func (storage *EncryptedStorage) writeSealed(name string, content []byte) error {
+	sealed, err := storage.seal(name, content)
+	if err != nil {
+		return err
+	}
+	return storage.inner.Put(name, sealed)
+}
+
+func (storage *EncryptedStorage) storedName(name string) string {
+	mac := hmac.New(sha256.New, storage.nameKey)
+	mac.Write([]byte(name))
+	sum := hex.EncodeToString(mac.Sum(nil))
+	return SEALED_DIR + "/" + sum[:2] + "/" + sum
+}
+
+// seal binds the content to its name, so files cannot be swapped around
+// without being noticed.
+func (storage *EncryptedStorage) seal(name string, data []byte) ([]byte, error) {
+	nonce := make([]byte, storage.aead.NonceSize(), storage.aead.NonceSize()+len(data)+storage.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return storage.aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func (storage *EncryptedStorage) open(name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < storage.aead.NonceSize() {
+		return nil, fmt.Errorf("%s is too short to be encrypted", name)
+	}
+	nonce := sealed[:storage.aead.NonceSize()]
+	data, err := storage.aead.Open(nil, nonce, sealed[len(nonce):], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+	}
+	return data, nil
+}
+
+func (storage *EncryptedStorage) Put(name string, data []byte) error {
+	sealed, err := storage.seal(name, data)
+	if err != nil {
+		return err
+	}
+	err = storage.inner.Put(storage.storedName(name), sealed)
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if !storage.names[name] {
+		storage.names[name] = true
+		storage.pending.Added = append(storage.pending.Added, name)
+		storage.dirty = true
+	}
+	// Event pages and bookkeeping are what a later run starts from, so their
+	// names are saved right away rather than when the storage is closed.
+	if strings.HasPrefix(name, EVENTS_DIR+"/") || strings.HasPrefix(name, JOURNAL_DIR+"/") {
+		return storage.saveChanges()
+	}
+	return nil
+}
+
+func (storage *EncryptedStorage) Get(name string) ([]byte, error) {
+	sealed, err := storage.inner.Get(storage.storedName(name))
+	if err != nil {
+		if errors.Is(err, ErrNotStored) {
+			return nil, fmt.Errorf("%s: %w", name, ErrNotStored)
+		}
+		return nil, err
+	}
+	return storage.open(name, sealed)
+}
+
+func (storage *EncryptedStorage) Exists(name string) bool {
+	return storage.inner.Exists(storage.storedName(name))
+}
+
+func (storage *EncryptedStorage) List(prefix string) ([]string, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	names := make([]string, 0, len(storage.names))
+	for name := range storage.names {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (storage *EncryptedStorage) Delete(name string) error {
+	err := storage.inner.Delete(storage.storedName(name))
+	if err != nil {
+		return err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if storage.names[name] {
+		delete(storage.names, name)
+		storage.pending.Removed = append(storage.pending.Removed, name)
+		storage.dirty = true
+	}
+	return nil
+}
+
+// saveChanges saves the names added and removed since the last changes file.
+func (storage *EncryptedStorage) saveChanges() error {
+	if len(storage.pending.Added) == 0 && len(storage.pending.Removed) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(storage.pending)
+	if err != nil {
+		return err
+	}
+	name := SEALED_INDEX_CHANGES + fmt.Sprintf("%08d", storage.changes+1)
+	err = storage.writeSealed(name, content)
+	if err != nil {
+		return fmt.Errorf("failed to save the encrypted index changes: %w", err)
+	}
+	storage.changes++
+	storage.changeFiles = append(storage.changeFiles, name)
+	storage.pending = sealedIndexChanges{}
+	return nil
+}
+
+// saveIndex saves the full index, which includes every changes file so far.
+// The changes files are removed afterwards where the storage allows it.
+func (storage *EncryptedStorage) saveIndex() error {
+	if !storage.dirty {
+		return nil
+	}
+	index := sealedIndex{Names: make([]string, 0, len(storage.names)), Changes: storage.changes}
+	for name := range storage.names {
+		index.Names = append(index.Names, name)
+	}
+	sort.Strings(index.Names)
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = storage.writeSealed(SEALED_INDEX, content)
+	if err != nil {
+		return fmt.Errorf("failed to save the encrypted index: %w", err)
+	}
+	storage.dirty = false
+	storage.pending = sealedIndexChanges{}
+	if canDelete(storage.inner) {
+		for _, name := range storage.changeFiles {
+			storage.inner.Delete(name)
+		}
+		storage.changeFiles = nil
+	}
+	return nil
+}
+
+func (storage *EncryptedStorage) Close() error {
+	storage.mutex.Lock()
+	err := storage.saveIndex()
+	storage.mutex.Unlock()
+	closeErr := storage.inner.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
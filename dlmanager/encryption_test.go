@@ -0,0 +1,221 @@
+package dlmanager
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return data
+}
+
+// The test vectors of RFC 7914, sections 11 and 12. The last scrypt vector
+// needs a GiB of memory and is left out.
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{"passwd", "salt", 1, "55 ac 04 6e 56 e3 08 9f ec 16 91 c2 25 44 b6 05 f9 41 85 21 6d de 04 65 e6 8b 9d 57 c2 0d ac bc 49 ca 9c cc f1 79 b6 45 99 16 64 b3 9d 77 ef 31 7c 71 b8 45 b1 e3 0b d5 09 11 20 41 d3 a1 97 83"},
+		{"Password", "NaCl", 80000, "4d dc d8 f6 0b 98 be 21 83 0c ee 5e f2 27 01 f9 64 1a 44 18 d0 4c 04 14 ae ff 08 87 6b 34 ab 56 a1 d4 25 a1 22 58 33 54 9a db 84 1b 51 c9 b3 17 6a 27 2b de bb a1 d0 78 47 8f 62 b3 97 f3 3c 8d"},
+	}
+	for _, test := range tests {
+		want := mustDecodeHex(t, test.want)
+		key := pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations, len(want))
+		if !bytes.Equal(key, want) {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %x, want %x", test.password, test.salt, test.iterations, key, want)
+		}
+	}
+}
+
+func TestScrypt(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		N, r, p  int
+		want     string
+	}{
+		{"", "", 16, 1, 1, "77 d6 57 62 38 65 7b 20 3b 19 ca 42 c1 8a 04 97 f1 6b 48 44 e3 07 4a e8 df df fa 3f ed e2 14 42 fc d0 06 9d ed 09 48 f8 32 6a 75 3a 0f c8 1f 17 e8 d3 e0 fb 2e 0d 36 28 cf 35 e2 0c 38 d1 89 06"},
+		{"password", "NaCl", 1024, 8, 16, "fd ba be 1c 9d 34 72 00 78 56 e7 19 0d 01 e9 fe 7c 6a d7 cb c8 23 78 30 e7 73 76 63 4b 37 31 62 2e af 30 d9 2e 22 a3 88 6f f1 09 27 9d 98 30 da c7 27 af b9 4a 83 ee 6d 83 60 cb df a2 cc 06 40"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1, "70 23 bd cb 3a fd 73 48 46 1c 06 cd 81 fd 38 eb fd a8 fb ba 90 4f 8e 3e a9 b5 43 f6 54 5d a1 f2 d5 43 29 55 61 3f 0f cf 62 d4 97 05 24 2a 9a f9 e6 1e 85 dc 0d 65 1e 40 df cf 01 7b 45 57 58 87"},
+	}
+	for _, test := range tests {
+		want := mustDecodeHex(t, test.want)
+		key, err := scrypt([]byte(test.password), []byte(test.salt), test.N, test.r, test.p, len(want))
+		if err != nil {
+			t.Fatalf("scrypt(%q, %q) failed: %v", test.password, test.salt, err)
+		}
+		if !bytes.Equal(key, want) {
+			t.Errorf("scrypt(%q, %q, %d, %d, %d) = %x, want %x", test.password, test.salt, test.N, test.r, test.p, key, want)
+		}
+	}
+
+	for _, N := range []int{0, 1, 1000} {
+		if _, err := scrypt([]byte("password"), []byte("salt"), N, 8, 1, 32); err == nil {
+			t.Errorf("scrypt accepted N = %d", N)
+		}
+	}
+}
+
+func encryptedOptions(dir string, storage string, passphrase string) Options {
+	return Options{OutputDir: dir, Storage: storage, Encrypt: true, Passphrase: passphrase}
+}
+
+func openEncrypted(t *testing.T, options Options) *EncryptedStorage {
+	t.Helper()
+	storage, err := OpenStorage(options, "1-2", filepath.Join(options.OutputDir, "1-2"))
+	if err != nil {
+		t.Fatalf("failed to open encrypted storage: %v", err)
+	}
+	return storage.(*EncryptedStorage)
+}
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	options := encryptedOptions(dir, STORAGE_DIR, "correct horse")
+	storage := openEncrypted(t, options)
+	mustPut(t, storage, "events/1.json", `{"page":1}`)
+	mustPut(t, storage, "photos/1_10.jpg", "secret photo")
+	files := map[string]string{"events/1.json": `{"page":1}`, "photos/1_10.jpg": "secret photo"}
+	expectStored(t, storage, files)
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Neither the names nor the content are stored in plain text.
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if strings.Contains(path, "events") || strings.Contains(path, "photos") {
+			t.Errorf("%s reveals a stored name", path)
+		}
+		content, _ := os.ReadFile(path)
+		if bytes.Contains(content, []byte("secret photo")) || bytes.Contains(content, []byte("page")) {
+			t.Errorf("%s holds stored content in plain text", path)
+		}
+		return nil
+	})
+
+	storage = openEncrypted(t, options)
+	defer storage.Close()
+	expectStored(t, storage, files)
+	expectListed(t, storage, "", []string{"events/1.json", "photos/1_10.jpg"})
+}
+
+// snapshot reads every file under dir.
+func snapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		files[path] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", dir, err)
+	}
+	return files
+}
+
+func TestEncryptedStorageWrongPassphrase(t *testing.T) {
+	for _, backend := range []string{STORAGE_DIR, STORAGE_TAR, STORAGE_ZIP} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			storage := openEncrypted(t, encryptedOptions(dir, backend, "correct horse"))
+			mustPut(t, storage, "events/1.json", `{"page":1}`)
+			if err := storage.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			before := snapshot(t, dir)
+
+			options := encryptedOptions(dir, backend, "battery staple")
+			_, err := OpenStorage(options, "1-2", filepath.Join(dir, "1-2"))
+			if !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("OpenStorage with a wrong passphrase = %v, want %v", err, ErrWrongKey)
+			}
+			after := snapshot(t, dir)
+			if len(after) != len(before) {
+				t.Errorf("files changed from %d to %d", len(before), len(after))
+			}
+			for path, content := range before {
+				if after[path] != content {
+					t.Errorf("%s was changed", path)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedStorageTampering(t *testing.T) {
+	dir := t.TempDir()
+	storage := openEncrypted(t, encryptedOptions(dir, STORAGE_DIR, "correct horse"))
+	defer storage.Close()
+	mustPut(t, storage, "events/1.json", `{"page":1}`)
+	mustPut(t, storage, "events/2.json", `{"page":2}`)
+	inner := storage.inner.(*DirStorage)
+
+	// A flipped bit in the ciphertext.
+	path := inner.Path(storage.storedName("events/1.json"))
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read sealed file: %v", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	os.WriteFile(path, sealed, 0644)
+	if data, err := storage.Get("events/1.json"); err == nil {
+		t.Errorf("Get of a tampered file = %q, want an error", data)
+	}
+
+	// A sealed file moved in place of another one.
+	sealed, _ = os.ReadFile(inner.Path(storage.storedName("events/2.json")))
+	os.WriteFile(path, sealed, 0644)
+	if data, err := storage.Get("events/1.json"); err == nil {
+		t.Errorf("Get of a swapped file = %q, want an error", data)
+	}
+}
+
+func TestEncryptedStorageNamesAreStable(t *testing.T) {
+	dir := t.TempDir()
+	options := encryptedOptions(dir, STORAGE_DIR, "correct horse")
+	storage := openEncrypted(t, options)
+	stored := storage.storedName("events/1.json")
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	storage = openEncrypted(t, options)
+	defer storage.Close()
+	if reopened := storage.storedName("events/1.json"); reopened != stored {
+		t.Errorf("stored name changed from %s to %s after reopening", stored, reopened)
+	}
+	// The name is the HMAC-SHA256 of the name, keyed with the names subkey.
+	master, err := loadArchiveKey(filepath.Join(dir, "1-2"), options)
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+	mac := hmac.New(sha256.New, deriveSubkey(master, "names"))
+	mac.Write([]byte("events/1.json"))
+	sum := hex.EncodeToString(mac.Sum(nil))
+	if want := SEALED_DIR + "/" + sum[:2] + "/" + sum; stored != want {
+		t.Errorf("stored name = %s, want %s", stored, want)
+	}
+}
@@ -0,0 +1,219 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/twitter"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EntryStats counts the archived entries of a conversation by type.
+type EntryStats struct {
+	Messages  int
+	Reactions int
+	Deleted   int
+	// System counts the conversation events by type. Entries of unknown types
+	// are counted under their own name.
+	System map[string]int
+	Users  int
+}
+
+func countEntries(entries []twitter.Entry) map[string]int {
+	counts := make(map[string]int)
+	for i := range entries {
+		entry := &entries[i]
+		if !entry.IsSystem() {
+			continue
+		}
+		kind := entry.Type
+		if kind == twitter.ENTRY_UNKNOWN {
+			kind = twitter.ENTRY_UNKNOWN + " (" + entry.UnknownType + ")"
+		}
+		counts[kind]++
+	}
+	return counts
+}
+
+// EntryStats counts the entries loaded by LoadEntries.
+func (dlManager *DLManager) EntryStats() *EntryStats {
+	stats := EntryStats{System: countEntries(dlManager.Entries), Users: len(dlManager.Users), Deleted: len(dlManager.Tombstones)}
+	for i := range dlManager.Entries {
+		if !dlManager.Entries[i].IsSystem() {
+			stats.Messages++
+			stats.Reactions += len(dlManager.Entries[i].Message.Reactions)
+		}
+	}
+	return &stats
+}
+
+func (stats *EntryStats) Print() {
+	logger.EventsLogger.Printf("Messages: %d\n", stats.Messages)
+	logger.EventsLogger.Printf("Deleted messages kept: %d\n", stats.Deleted)
+	logger.EventsLogger.Printf("Reactions on messages: %d\n", stats.Reactions)
+	logger.EventsLogger.Printf("Participants: %d\n", stats.Users)
+	kinds := make([]string, 0, len(stats.System))
+	total := 0
+	for kind, count := range stats.System {
+		kinds = append(kinds, kind)
+		total += count
+	}
+	sort.Strings(kinds)
+	logger.EventsLogger.Printf("Conversation events: %d\n", total)
+	for _, kind := range kinds {
+		logger.EventsLogger.Printf("\t%s: %d\n", kind, stats.System[kind])
+	}
+}
+
+// attachReactions applies the reaction_create and reaction_delete entries to
+// the reactions of the messages they target, on top of the reactions each
+// message had when it was fetched. The entries must be sorted oldest first.
+func attachReactions(entries []twitter.Entry) {
+	messages := make(map[string]*twitter.Message)
+	for i := range entries {
+		if id := entries[i].GetMessageId(); id != "" {
+			messages[id] = entries[i].Message
+		}
+	}
+	// A user has at most one reaction of each kind on a message.
+	reactionKey := func(reaction *twitter.ReactionEvent) string {
+		return reaction.SenderID + "/" + reactionEmoji(reaction)
+	}
+	for i := range entries {
+		var reaction *twitter.ReactionEvent
+		switch entries[i].Type {
+		case twitter.ENTRY_REACTION_CREATE:
+			reaction = entries[i].ReactionCreate
+		case twitter.ENTRY_REACTION_DELETE:
+			reaction = entries[i].ReactionDelete
+		default:
+			continue
+		}
+		message, ok := messages[reaction.MessageID]
+		if !ok {
+			continue
+		}
+		found := -1
+		for j := range message.Reactions {
+			if reactionKey(&message.Reactions[j]) == reactionKey(reaction) {
+				found = j
+				break
+			}
+		}
+		if entries[i].Type == twitter.ENTRY_REACTION_CREATE {
+			if found == -1 {
+				message.Reactions = append(message.Reactions, *reaction)
+			}
+		} else if found != -1 && message.Reactions[found].Time <= reaction.Time {
+			message.Reactions = append(message.Reactions[:found], message.Reactions[found+1:]...)
+		}
+	}
+}
+
+// resolveReplies points every reply to the message it replies to, when that
+// message is archived.
+func resolveReplies(entries []twitter.Entry) {
+	messages := make(map[string]*twitter.Message)
+	for i := range entries {
+		if id := entries[i].GetMessageId(); id != "" {
+			messages[id] = entries[i].Message
+		}
+	}
+	for i := range entries {
+		if entries[i].Message == nil || entries[i].Message.MessageData.ReplyData == nil {
+			continue
+		}
+		entries[i].Message.ReplyTo = messages[entries[i].Message.MessageData.ReplyData.ID]
+	}
+}
+
+// ReactionCount aggregates the reactions of a message with the same emoji.
+type ReactionCount struct {
+	Emoji     string
+	Reactions []twitter.ReactionEvent
+}
+
+// countReactions groups the reactions of a message by emoji, in the order each
+// emoji was first used.
+func countReactions(reactions []twitter.ReactionEvent) []ReactionCount {
+	counts := make([]ReactionCount, 0)
+	positions := make(map[string]int)
+	for _, reaction := range reactions {
+		emoji := reactionEmoji(&reaction)
+		position, ok := positions[emoji]
+		if !ok {
+			position = len(counts)
+			positions[emoji] = position
+			counts = append(counts, ReactionCount{Emoji: emoji})
+		}
+		counts[position].Reactions = append(counts[position].Reactions, reaction)
+	}
+	return counts
+}
+
+// userName names a user by screen name when the conversation knows it.
+func userName(users map[string]twitter.User, id string) string {
+	if user, ok := users[id]; ok && user.ScreenName != "" {
+		return "@" + user.ScreenName
+	}
+	if id == "" {
+		return "someone"
+	}
+	return id
+}
+
+func participantNames(users map[string]twitter.User, participants []twitter.Participant) string {
+	names := make([]string, 0, len(participants))
+	for _, participant := range participants {
+		names = append(names, userName(users, participant.UserID))
+	}
+	return strings.Join(names, ", ")
+}
+
+// reactionEmoji falls back to the reaction key, which older reactions have
+// instead of an emoji.
+func reactionEmoji(reaction *twitter.ReactionEvent) string {
+	if reaction.EmojiReaction != "" {
+		return reaction.EmojiReaction
+	}
+	return reaction.ReactionKey
+}
+
+// describeSystemEntry tells what happened in a conversation event, for the
+// system lines of the exports.
+func describeSystemEntry(entry twitter.Entry, users map[string]twitter.User) string {
+	switch entry.Type {
+	case twitter.ENTRY_PARTICIPANTS_JOIN:
+		change := entry.ParticipantsJoin
+		return fmt.Sprintf("%s added %s", userName(users, change.SenderID), participantNames(users, change.Participants))
+	case twitter.ENTRY_PARTICIPANTS_LEAVE:
+		return fmt.Sprintf("%s left", participantNames(users, entry.ParticipantsLeave.Participants))
+	case twitter.ENTRY_JOIN_CONVERSATION:
+		change := entry.JoinConversation
+		return fmt.Sprintf("%s joined the conversation, added by %s", participantNames(users, change.Participants), userName(users, change.SenderID))
+	case twitter.ENTRY_CONVERSATION_CREATE:
+		return "Conversation created"
+	case twitter.ENTRY_CONVERSATION_NAME_UPDATE:
+		update := entry.ConversationNameUpdate
+		return fmt.Sprintf("%s renamed the conversation to %q", userName(users, update.ByUserID), update.ConversationName)
+	case twitter.ENTRY_CONVERSATION_AVATAR_UPDATE:
+		return fmt.Sprintf("%s changed the conversation picture", userName(users, entry.ConversationAvatarUpdate.ByUserID))
+	case twitter.ENTRY_MESSAGE_DELETE:
+		return fmt.Sprintf("%d messages deleted", len(entry.MessageDelete.Messages))
+	case twitter.ENTRY_TRUST_CONVERSATION:
+		return fmt.Sprintf("Conversation accepted (%s)", entry.TrustConversation.Reason)
+	case twitter.ENTRY_REACTION_CREATE:
+		reaction := entry.ReactionCreate
+		return fmt.Sprintf("%s reacted %s to message %s", userName(users, reaction.SenderID), reactionEmoji(reaction), reaction.MessageID)
+	case twitter.ENTRY_REACTION_DELETE:
+		reaction := entry.ReactionDelete
+		return fmt.Sprintf("%s removed the reaction %s from message %s", userName(users, reaction.SenderID), reactionEmoji(reaction), reaction.MessageID)
+	case twitter.ENTRY_DISABLE_NOTIFICATIONS:
+		return fmt.Sprintf("%s muted the conversation", userName(users, entry.DisableNotifications.ByUserID))
+	case twitter.ENTRY_ENABLE_NOTIFICATIONS:
+		return fmt.Sprintf("%s unmuted the conversation", userName(users, entry.EnableNotifications.ByUserID))
+	case twitter.ENTRY_CONVERSATION_READ:
+		return "Conversation read"
+	}
+	return fmt.Sprintf("Unsupported event %s", entry.UnknownType)
+}
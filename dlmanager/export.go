@@ -0,0 +1,427 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/twitter"
+	"XDMArchiver/utils"
+	"bufio"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	EXPORT_TEXT = "text"
+	EXPORT_HTML = "html"
+)
+
+var exportExtensions = map[string]string{
+	EXPORT_TEXT: "txt",
+	EXPORT_HTML: "html",
+}
+
+// ExportEntry is an entry of the conversation as it is shown in the exports.
+type ExportEntry struct {
+	ID     string
+	Time   string
+	System bool
+	Sender string
+	Text   string
+	// RichText is the text as HTML, with links for the entities.
+	RichText  template.HTML
+	Media     []ExportMedia
+	Tweet     *ExportTweet
+	Card      *ExportCard
+	Reply     *ExportReply
+	Reactions []ExportReaction
+	// EditCount is 0 for messages that were never edited. EditedAt is only
+	// known when the API tells it.
+	EditCount        int
+	EditedAt         string
+	PreviousVersions []string
+	// DeletedAt is set for messages deleted from the conversation after they
+	// were archived, with LastSeenAt when known.
+	DeletedAt  string
+	LastSeenAt string
+}
+
+// ExportReply quotes the message a reply is for. Archived tells whether it was
+// taken from the archived message rather than the preview sent with the reply.
+type ExportReply struct {
+	ID       string
+	Sender   string
+	Text     string
+	Archived bool
+}
+
+// ExportTweet is a tweet shared in a message.
+type ExportTweet struct {
+	Author string
+	Text   string
+	URL    string
+}
+
+// ExportCard is the preview of a link shared in a message.
+type ExportCard struct {
+	Title       string
+	Description string
+	Domain      string
+	URL         string
+}
+
+type ExportMedia struct {
+	MediaType string
+	IsVideo   bool
+	// Duration is the length of voice messages as m:ss, when known.
+	Duration string
+	// Path is relative to the export file for media stored in a directory, and
+	// the name in the archive file otherwise.
+	Path string
+}
+
+// ExportReaction is an emoji used to react to a message, with everyone who
+// reacted with it.
+type ExportReaction struct {
+	Emoji string
+	Count int
+	Users []ExportReactionUser
+}
+
+type ExportReactionUser struct {
+	Name string
+	Time string
+}
+
+type ExportReport struct {
+	Path     string
+	Messages int
+	System   int
+}
+
+func (report *ExportReport) Print() {
+	logger.EventsLogger.Printf("Exported %d messages and %d conversation events to %s\n", report.Messages, report.System, report.Path)
+}
+
+// DefaultExportPath is where the export of the given format is written when no
+// path is given, next to the archive of the conversation.
+func (dlManager *DLManager) DefaultExportPath(format string) string {
+	return filepath.Join(dlManager.ConversationPath, "export."+exportExtensions[format])
+}
+
+func isExportFile(name string) bool {
+	for _, ext := range exportExtensions {
+		if name == "export."+ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Export writes the archived conversation, oldest first, in the given format.
+// Conversation events are written as system lines between the messages.
+func (dlManager *DLManager) Export(format string, path string) (*ExportReport, error) {
+	if _, ok := exportExtensions[format]; !ok {
+		return nil, fmt.Errorf("unknown export format %s", format)
+	}
+	if path == "" {
+		// The export is plain text, it must not end up next to the sealed files
+		// without being asked for.
+		if dlManager.Options.Encrypt {
+			return nil, fmt.Errorf("the export of an encrypted conversation is not encrypted, choose where to write it with --export-file")
+		}
+		path = dlManager.DefaultExportPath(format)
+	}
+	if dlManager.Entries == nil {
+		err := dlManager.LoadEntries()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	messages := make(map[string]bool)
+	for _, entry := range dlManager.Entries {
+		if id := entry.GetMessageId(); id != "" {
+			messages[id] = true
+		}
+	}
+
+	// The media shown are the files the manifest records, whatever the options
+	// they were downloaded with.
+	media := dlManager.Manifest.ByMessage()
+	report := ExportReport{Path: path}
+	entries := make([]ExportEntry, 0, len(dlManager.Entries))
+	for _, entry := range dlManager.Entries {
+		// Reactions are shown on the message they target, when it was archived.
+		if reaction := reactionOf(entry); reaction != nil && messages[reaction.MessageID] {
+			continue
+		}
+		exported := dlManager.exportEntry(entry, media[entry.GetMessageId()], filepath.Dir(path))
+		if exported.System {
+			report.System++
+		} else {
+			report.Messages++
+		}
+		entries = append(entries, exported)
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export %s: %w", path, err)
+	}
+	writer := bufio.NewWriter(file)
+	switch format {
+	case EXPORT_TEXT:
+		err = writeTextExport(writer, entries)
+	case EXPORT_HTML:
+		err = writeHTMLExport(writer, dlManager.ConversationId, entries)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write export %s: %w", path, err)
+	}
+	return &report, nil
+}
+
+func (dlManager *DLManager) exportEntry(entry twitter.Entry, media []ManifestRecord, exportDir string) ExportEntry {
+	exported := ExportEntry{Time: dlManager.formatEntryTime(entry.Time())}
+	if entry.IsSystem() {
+		exported.System = true
+		exported.Text = describeSystemEntry(entry, dlManager.Users)
+		return exported
+	}
+
+	exported.ID = entry.GetMessageId()
+	exported.Sender = userName(dlManager.Users, entry.Message.MessageData.SenderID)
+	exported.Text = entry.Message.MessageData.PlainText()
+	exported.RichText = template.HTML(entry.Message.MessageData.RichText())
+	if attachment := entry.Message.MessageData.Attachment; attachment != nil {
+		if shared := attachment.Tweet; shared != nil {
+			tweet := ExportTweet{URL: shared.ExpandedURL}
+			if tweet.URL == "" {
+				tweet.URL = shared.URL
+			}
+			if shared.Status != nil {
+				tweet.Text = html.UnescapeString(shared.Status.GetText())
+				if shared.Status.User != nil {
+					tweet.Author = "@" + shared.Status.User.ScreenName
+				}
+			}
+			exported.Tweet = &tweet
+		}
+		if card := attachment.Card; card != nil {
+			exported.Card = &ExportCard{Title: card.Title(), Description: card.Description(), Domain: card.Domain(), URL: entry.Message.MessageData.ExpandURL(card.URL)}
+		}
+	}
+	if replyData := entry.Message.MessageData.ReplyData; replyData != nil {
+		reply := ExportReply{ID: replyData.ID, Sender: userName(dlManager.Users, replyData.SenderID), Text: html.UnescapeString(replyData.Text)}
+		if target := entry.Message.ReplyTo; target != nil {
+			reply.Sender = userName(dlManager.Users, target.MessageData.SenderID)
+			reply.Text = target.MessageData.PlainText()
+			reply.Archived = true
+		}
+		exported.Reply = &reply
+	}
+	for _, record := range media {
+		exported.Media = append(exported.Media, ExportMedia{
+			MediaType: record.MediaType,
+			IsVideo:   path.Ext(record.Path) == ".mp4" || path.Ext(record.Path) == ".ts",
+			Duration:  formatDuration(record.DurationMs),
+			Path:      dlManager.exportMediaPath(record.Path, exportDir),
+		})
+	}
+	if tombstone, ok := dlManager.Tombstones[entryKey(entry)]; ok {
+		exported.DeletedAt = tombstone.DetectedAt.In(dlManager.Options.Location).Format(time.DateTime)
+		exported.LastSeenAt = "unknown"
+		if tombstone.LastSeenAt != nil {
+			exported.LastSeenAt = tombstone.LastSeenAt.In(dlManager.Options.Location).Format(time.DateTime)
+		}
+	}
+	exported.PreviousVersions = dlManager.previousVersions(entry)
+	exported.EditCount = entry.Message.MessageData.Edits()
+	if exported.EditCount < len(exported.PreviousVersions) {
+		exported.EditCount = len(exported.PreviousVersions)
+	}
+	if editedAt := string(entry.Message.MessageData.EditedAt); editedAt != "" {
+		exported.EditedAt = dlManager.formatEntryTime(editedAt)
+	}
+	for _, count := range countReactions(entry.Message.Reactions) {
+		reaction := ExportReaction{Emoji: count.Emoji, Count: len(count.Reactions)}
+		for _, user := range count.Reactions {
+			reaction.Users = append(reaction.Users, ExportReactionUser{
+				Name: userName(dlManager.Users, user.SenderID),
+				Time: dlManager.formatEntryTime(user.Time),
+			})
+		}
+		exported.Reactions = append(exported.Reactions, reaction)
+	}
+	return exported
+}
+
+func reactionOf(entry twitter.Entry) *twitter.ReactionEvent {
+	switch entry.Type {
+	case twitter.ENTRY_REACTION_CREATE:
+		return entry.ReactionCreate
+	case twitter.ENTRY_REACTION_DELETE:
+		return entry.ReactionDelete
+	}
+	return nil
+}
+
+func (dlManager *DLManager) exportMediaPath(name string, exportDir string) string {
+	dirStorage, ok := dlManager.Storage.(*DirStorage)
+	if !ok {
+		return name
+	}
+	target, err := filepath.Abs(dirStorage.Path(name))
+	if err == nil {
+		exportDir, err = filepath.Abs(exportDir)
+	}
+	if err != nil {
+		return dirStorage.Path(name)
+	}
+	relative, err := filepath.Rel(exportDir, target)
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(relative)
+}
+
+// formatDuration formats a length in milliseconds as m:ss, or returns an empty
+// string when it is unknown.
+func formatDuration(durationMs int) string {
+	if durationMs <= 0 {
+		return ""
+	}
+	seconds := (durationMs + 500) / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+func (dlManager *DLManager) formatEntryTime(timestamp string) string {
+	t, err := utils.UnixTimestampStringToTime(timestamp, true)
+	if err != nil {
+		return timestamp
+	}
+	return t.In(dlManager.Options.Location).Format(time.DateTime)
+}
+
+func writeTextExport(writer io.Writer, entries []ExportEntry) error {
+	for _, entry := range entries {
+		var err error
+		if entry.System {
+			_, err = fmt.Fprintf(writer, "[%s] * %s\n", entry.Time, entry.Text)
+		} else {
+			text := strings.ReplaceAll(entry.Text, "\n", "\n\t")
+			_, err = fmt.Fprintf(writer, "[%s] %s: %s\n", entry.Time, entry.Sender, text)
+		}
+		if err == nil && entry.Reply != nil {
+			quote := strings.ReplaceAll(entry.Reply.Text, "\n", "\n\t> ")
+			_, err = fmt.Fprintf(writer, "\t> Replying to %s: %s\n", entry.Reply.Sender, quote)
+		}
+		if err == nil && entry.Tweet != nil {
+			text := strings.ReplaceAll(entry.Tweet.Text, "\n", "\n\t| ")
+			_, err = fmt.Fprintf(writer, "\tShared tweet by %s (%s):\n\t| %s\n", entry.Tweet.Author, entry.Tweet.URL, text)
+		}
+		if err == nil && entry.Card != nil {
+			_, err = fmt.Fprintf(writer, "\tLink preview: %s - %s (%s)\n", entry.Card.Title, entry.Card.Description, entry.Card.URL)
+		}
+		for i := 0; err == nil && i < len(entry.Media); i++ {
+			media := entry.Media[i]
+			if media.Duration != "" {
+				_, err = fmt.Fprintf(writer, "\t%s (%s): %s\n", media.MediaType, media.Duration, media.Path)
+			} else {
+				_, err = fmt.Fprintf(writer, "\t%s: %s\n", media.MediaType, media.Path)
+			}
+		}
+		if err == nil && entry.DeletedAt != "" {
+			_, err = fmt.Fprintf(writer, "\tDeleted, detected at %s, last seen at %s\n", entry.DeletedAt, entry.LastSeenAt)
+		}
+		if err == nil && entry.EditCount > 0 {
+			if entry.EditedAt != "" {
+				_, err = fmt.Fprintf(writer, "\tEdited %d times, last at %s\n", entry.EditCount, entry.EditedAt)
+			} else {
+				_, err = fmt.Fprintf(writer, "\tEdited %d times\n", entry.EditCount)
+			}
+		}
+		for i := 0; err == nil && i < len(entry.PreviousVersions); i++ {
+			text := strings.ReplaceAll(entry.PreviousVersions[i], "\n", "\n\t\t")
+			_, err = fmt.Fprintf(writer, "\t\tPrevious version: %s\n", text)
+		}
+		if err == nil && len(entry.Reactions) > 0 {
+			counts := make([]string, 0, len(entry.Reactions))
+			for _, reaction := range entry.Reactions {
+				counts = append(counts, fmt.Sprintf("%s %d", reaction.Emoji, reaction.Count))
+			}
+			_, err = fmt.Fprintf(writer, "\tReactions: %s\n", strings.Join(counts, ", "))
+		}
+		for _, reaction := range entry.Reactions {
+			for i := 0; err == nil && i < len(reaction.Users); i++ {
+				_, err = fmt.Fprintf(writer, "\t\t%s %s [%s]\n", reaction.Emoji, reaction.Users[i].Name, reaction.Users[i].Time)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var htmlExportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Conversation {{.ConversationId}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: auto; }
+.entry { margin: 0.5em 0; }
+.time { color: #888; font-size: 0.8em; }
+.system { color: #888; font-style: italic; text-align: center; }
+.text { white-space: pre-wrap; }
+.reply { border-left: 3px solid #ccc; margin: 0.2em 0; padding-left: 0.5em; color: #555; white-space: pre-wrap; }
+.shared { border: 1px solid #ddd; border-radius: 0.5em; margin: 0.2em 0; padding: 0.5em; white-space: pre-wrap; }
+.reply a { color: inherit; text-decoration: none; }
+.deleted { color: #c33; font-size: 0.8em; }
+.edited { color: #888; font-size: 0.8em; }
+.reaction { display: inline-block; border: 1px solid #ddd; border-radius: 1em; padding: 0 0.5em; margin-right: 0.3em; }
+img, video { max-width: 100%; max-height: 30em; display: block; }
+.voice { color: #888; font-size: 0.8em; }
+</style>
+</head>
+<body>
+{{range .Entries}}{{if .System}}<div class="entry system"><span class="time">{{.Time}}</span> {{.Text}}</div>
+{{else}}<div class="entry" id="m{{.ID}}"><span class="time">{{.Time}}</span> <b>{{.Sender}}</b>
+{{with .Reply}}<div class="reply">{{if .Archived}}<a href="#m{{.ID}}">{{end}}Replying to {{.Sender}}: {{.Text}}{{if .Archived}}</a>{{end}}</div>
+{{end}}<div class="text">{{.RichText}}</div>
+{{if .DeletedAt}}<div class="deleted">Deleted, detected at {{.DeletedAt}}, last seen at {{.LastSeenAt}}</div>
+{{end}}{{if .EditCount}}<details class="edited"><summary>Edited {{.EditCount}} times{{if .EditedAt}}, last at {{.EditedAt}}{{end}}</summary>{{range .PreviousVersions}}<div class="text">{{.}}</div>{{end}}</details>
+{{end}}{{with .Tweet}}<div class="shared"><a href="{{.URL}}">Shared tweet by {{.Author}}</a>
+{{.Text}}</div>
+{{end}}{{with .Card}}<div class="shared"><a href="{{.URL}}"><b>{{.Title}}</b></a> {{.Domain}}
+{{.Description}}</div>
+{{end}}{{range .Media}}{{if eq .MediaType "Voice"}}<div class="voice"><audio controls src="{{.Path}}"></audio>{{with .Duration}} {{.}}{{end}}</div>{{else if eq .MediaType "Gif"}}<video autoplay loop muted playsinline src="{{.Path}}"></video>{{else if .IsVideo}}<video controls src="{{.Path}}"></video>{{else}}<a href="{{.Path}}"><img src="{{.Path}}"></a>{{end}}
+{{end}}{{if .Reactions}}<div class="reactions">{{range .Reactions}}<span class="reaction" title="{{range $i, $user := .Users}}{{if $i}}, {{end}}{{$user.Name}} at {{$user.Time}}{{end}}">{{.Emoji}} {{.Count}}</span>{{end}}</div>
+{{end}}</div>
+{{end}}{{end}}</body>
+</html>
+`))
+
+func writeHTMLExport(writer io.Writer, conversationId string, entries []ExportEntry) error {
+	return htmlExportTemplate.Execute(writer, struct {
+		ConversationId string
+		Entries        []ExportEntry
+	}{conversationId, entries})
+}
@@ -0,0 +1,88 @@
+package dlmanager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportTestPage has a message with a reaction, a reply to it, an edited
+// message and a message that was deleted afterwards.
+const exportTestPage = `{"conversation_timeline":{"status":"AT_END","entries":[
+{"message":{"id":"13","time":"1700000004000","message_data":{"id":"13","time":"1700000004000","sender_id":"6","text":"oops"}}},
+{"message":{"id":"12","time":"1700000003000","message_data":{"id":"12","time":"1700000003000","sender_id":"5","text":"see you at 6","edit_count":"1","edited_at":"1700000005000","edit_history":[{"text":"see you at 5"}]}}},
+{"reaction_create":{"id":"14","time":"1700000002000","message_id":"10","reaction_key":"emoji","emoji_reaction":"👍","sender_id":"6"}},
+{"message":{"id":"11","time":"1700000001000","message_data":{"id":"11","time":"1700000001000","sender_id":"6","text":"hi &amp; welcome","reply_data":{"id":"10","sender_id":"5","text":"hello"}}}},
+{"message":{"id":"10","time":"1700000000000","message_data":{"id":"10","time":"1700000000000","sender_id":"5","text":"hello <there>"}}}
+],"users":{"5":{"id_str":"5","screen_name":"alice"},"6":{"id_str":"6","screen_name":"bob"}}}}`
+
+func openExportTest(t *testing.T) *DLManager {
+	t.Helper()
+	dlManager := newTestManager(t)
+	manifest, err := loadManifest(&fileJournal{Path: filepath.Join(dlManager.ConversationPath, MANIFEST_FILE)})
+	if err != nil {
+		t.Fatalf("loadManifest failed: %v", err)
+	}
+	dlManager.Manifest = manifest
+	mustPut(t, dlManager.Storage, "events/1.json", exportTestPage)
+
+	tombstone := Tombstone{MessageId: "13", Time: "1700000004000", Reason: DELETION_VANISHED, DetectedAt: time.Date(2023, 11, 15, 8, 0, 0, 0, time.UTC), Page: "events/1.json"}
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		t.Fatalf("failed to encode tombstone: %v", err)
+	}
+	mustPut(t, dlManager.Storage, tombstoneName("13"), string(data))
+	return dlManager
+}
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{EXPORT_TEXT, []string{
+			"[2023-11-14 22:13:20] @alice: hello <there>\n" +
+				"\tReactions: 👍 1\n" +
+				"\t\t👍 @bob [2023-11-14 22:13:22]\n" +
+				"[2023-11-14 22:13:21] @bob: hi & welcome\n" +
+				"\t> Replying to @alice: hello <there>\n" +
+				"[2023-11-14 22:13:23] @alice: see you at 6\n" +
+				"\tEdited 1 times, last at 2023-11-14 22:13:25\n" +
+				"\t\tPrevious version: see you at 5\n" +
+				"[2023-11-14 22:13:24] @bob: oops\n" +
+				"\tDeleted, detected at 2023-11-15 08:00:00, last seen at unknown\n",
+		}},
+		{EXPORT_HTML, []string{
+			`<div class="entry" id="m10"><span class="time">2023-11-14 22:13:20</span> <b>@alice</b>` + "\n" + `<div class="text">hello &lt;there&gt;</div>`,
+			`<span class="reaction" title="@bob at 2023-11-14 22:13:22">👍 1</span>`,
+			`<div class="reply"><a href="#m10">Replying to @alice: hello &lt;there&gt;</a></div>` + "\n" + `<div class="text">hi &amp; welcome</div>`,
+			`<summary>Edited 1 times, last at 2023-11-14 22:13:25</summary><div class="text">see you at 5</div>`,
+			`<div class="text">oops</div>` + "\n" + `<div class="deleted">Deleted, detected at 2023-11-15 08:00:00, last seen at unknown</div>`,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			dlManager := openExportTest(t)
+			path := filepath.Join(t.TempDir(), "export."+exportExtensions[test.format])
+			report, err := dlManager.Export(test.format, path)
+			if err != nil {
+				t.Fatalf("Export failed: %v", err)
+			}
+			if report.Messages != 4 || report.System != 0 {
+				t.Errorf("exported %d messages and %d events, want 4 messages and the reaction shown on its message", report.Messages, report.System)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read export: %v", err)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(string(content), want) {
+					t.Errorf("export does not have\n%s\nin\n%s", want, content)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package dlmanager
+
+import (
+	"XDMArchiver/twitter"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	FAILURES_FILE = "failures.jsonl"
+
+	ERROR_CLASS_HTTP    = "http"
+	ERROR_CLASS_NETWORK = "network"
+	ERROR_CLASS_WRITE   = "write"
+	ERROR_CLASS_INVALID = "invalid"
+	// ERROR_CLASS_UNSUPPORTED is media XDMArchiver cannot save yet, which
+	// retry-failed skips.
+	ERROR_CLASS_UNSUPPORTED = "unsupported"
+)
+
+// FailedDownload is a single line of the failures ledger. It embeds the
+// media unit so it can be re-attempted exactly as it was first tried.
+type FailedDownload struct {
+	MediaUnit
+	ErrorClass  string    `json:"error_class"`
+	HTTPStatus  int       `json:"http_status,omitempty"`
+	Error       string    `json:"error"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// FailureLedger keeps track of the media that could not be downloaded, at most
+// one record per target file, so they can be retried later.
+type FailureLedger struct {
+	journal  journal
+	mutex    sync.Mutex
+	failures []FailedDownload
+}
+
+func loadFailureLedger(journal journal) (*FailureLedger, error) {
+	ledger := FailureLedger{
+		journal:  journal,
+		failures: make([]FailedDownload, 0),
+	}
+
+	content, err := journal.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open failures ledger: %w", err)
+	}
+	path := journal.Location()
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var failure FailedDownload
+		err = json.Unmarshal(scanner.Bytes(), &failure)
+		if err != nil {
+			return nil, fmt.Errorf("failed to json decode line %d of %s: %w", line, path, err)
+		}
+		ledger.upsert(failure)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read failures ledger %s: %w", path, err)
+	}
+
+	return &ledger, nil
+}
+
+// Location tells where the ledger is kept.
+func (ledger *FailureLedger) Location() string {
+	return ledger.journal.Location()
+}
+
+func (ledger *FailureLedger) Failures() []FailedDownload {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	failures := make([]FailedDownload, len(ledger.failures))
+	copy(failures, ledger.failures)
+	return failures
+}
+
+func (ledger *FailureLedger) Has(unit MediaUnit) bool {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	for i := range ledger.failures {
+		if ledger.failures[i].MediaType == unit.MediaType && ledger.failures[i].Filename == unit.Filename {
+			return true
+		}
+	}
+	return false
+}
+
+func (ledger *FailureLedger) Record(unit MediaUnit, errorClass string, cause error) error {
+	failure := FailedDownload{
+		MediaUnit:   unit,
+		ErrorClass:  errorClass,
+		Error:       cause.Error(),
+		AttemptedAt: time.Now(),
+	}
+	var statusError *twitter.ErrNot200
+	if errors.As(cause, &statusError) {
+		failure.HTTPStatus = statusError.StatusCode
+	}
+
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	ledger.upsert(failure)
+	return ledger.save()
+}
+
+func (ledger *FailureLedger) Resolve(unit MediaUnit) error {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	for i := range ledger.failures {
+		if ledger.failures[i].MediaType == unit.MediaType && ledger.failures[i].Filename == unit.Filename {
+			ledger.failures = append(ledger.failures[:i], ledger.failures[i+1:]...)
+			return ledger.save()
+		}
+	}
+	return nil
+}
+
+// Replace points the failure recorded for an old file name to a new unit.
+func (ledger *FailureLedger) Replace(mediaType string, oldFilename string, unit MediaUnit) error {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	for i := range ledger.failures {
+		if ledger.failures[i].MediaType == mediaType && ledger.failures[i].Filename == oldFilename {
+			ledger.failures[i].MediaUnit = unit
+			return ledger.save()
+		}
+	}
+	return nil
+}
+
+func (ledger *FailureLedger) upsert(failure FailedDownload) {
+	for i := range ledger.failures {
+		if ledger.failures[i].MediaType == failure.MediaType && ledger.failures[i].Filename == failure.Filename {
+			ledger.failures[i] = failure
+			return
+		}
+	}
+	ledger.failures = append(ledger.failures, failure)
+}
+
+// save rewrites the ledger, which is removed once it is empty.
+func (ledger *FailureLedger) save() error {
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	for _, failure := range ledger.failures {
+		if err := encoder.Encode(failure); err != nil {
+			return fmt.Errorf("failed to encode failure: %w", err)
+		}
+	}
+	if err := ledger.journal.Replace(content.Bytes()); err != nil {
+		return fmt.Errorf("failed to replace failures ledger: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package dlmanager
+
+import (
+	"XDMArchiver/hls"
+	"XDMArchiver/logger"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var errInvalidPlaylist = errors.New("invalid hls playlist")
+
+// errUnsupportedPlaylist is a valid playlist that cannot be saved.
+var errUnsupportedPlaylist = errors.New("unsupported hls playlist")
+
+// hlsStream is the stream of an HLS playlist a video was joined from.
+type hlsStream struct {
+	Variant   hls.Variant
+	Container string
+	Segments  int
+}
+
+func isHLS(unit MediaUnit) bool {
+	return strings.EqualFold(unit.ContentType, hls.CONTENT_TYPE)
+}
+
+// getMedia downloads the file of a media unit. HLS playlists are downloaded
+// segment by segment and joined, the stream they were joined from is returned
+// along with them.
+func (dlManager *DLManager) getMedia(unit MediaUnit) ([]byte, *hlsStream, error) {
+	if !isHLS(unit) {
+		data, err := dlManager.TwitterCtx.GetFile(unit.URL)
+		return data, nil, err
+	}
+	return dlManager.downloadHLS(unit)
+}
+
+func (dlManager *DLManager) fetchPlaylist(playlistUrl string) (*hls.Playlist, error) {
+	data, err := dlManager.TwitterCtx.GetFile(playlistUrl)
+	if err != nil {
+		return nil, err
+	}
+	playlist, err := hls.Parse(data, playlistUrl)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", errInvalidPlaylist, playlistUrl, err)
+	}
+	return playlist, nil
+}
+
+func (dlManager *DLManager) downloadHLS(unit MediaUnit) ([]byte, *hlsStream, error) {
+	playlist, err := dlManager.fetchPlaylist(unit.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := hlsStream{Variant: hls.Variant{URL: unit.URL}}
+	if playlist.IsMaster() {
+		// Joining segments cannot mux an audio rendition into the video, so only
+		// the streams with their audio inside are picked from.
+		variants := make([]hls.Variant, 0, len(playlist.Variants))
+		for _, variant := range playlist.Variants {
+			if !playlist.SeparateAudio(variant) {
+				variants = append(variants, variant)
+			}
+		}
+		if len(variants) == 0 {
+			return nil, nil, fmt.Errorf("%w %s: every stream has its audio in a separate rendition, which is not supported", errUnsupportedPlaylist, unit.URL)
+		}
+		stream.Variant = dlManager.Options.VideoQuality.selectStream(variants)
+		logger.MediaLogger.Printf("Picked HLS stream %s (%d bps) of %s\n", stream.Variant.Resolution, stream.Variant.Bandwidth, unit.Filename)
+		playlist, err = dlManager.fetchPlaylist(stream.Variant.URL)
+		if err != nil {
+			return nil, nil, err
+		}
+		if playlist.IsMaster() {
+			return nil, nil, fmt.Errorf("%w %s: a master playlist lists another master playlist", errInvalidPlaylist, stream.Variant.URL)
+		}
+	}
+	stream.Container = playlist.Container()
+	stream.Segments = len(playlist.Segments)
+	if (stream.Container == hls.CONTAINER_FMP4) != (path.Ext(unit.Filename) == ".mp4") {
+		return nil, nil, fmt.Errorf("%w %s: it has %s segments, which cannot be saved as %s", errInvalidPlaylist, stream.Variant.URL, stream.Container, unit.Filename)
+	}
+
+	var init []byte
+	if playlist.InitURL != "" {
+		init, err = dlManager.TwitterCtx.GetFile(playlist.InitURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to download initialization segment: %w", err)
+		}
+	}
+	segments := make([][]byte, 0, len(playlist.Segments))
+	for i, segment := range playlist.Segments {
+		data, err := dlManager.TwitterCtx.GetFile(segment.URL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to download segment %d of %d: %w", i+1, len(playlist.Segments), err)
+		}
+		segments = append(segments, data)
+	}
+	logger.MediaLogger.Printf("Joining %d %s segments of %s\n", len(segments), stream.Container, unit.Filename)
+	return hls.Join(init, segments), &stream, nil
+}
@@ -0,0 +1,443 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/twitter"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	INDEX_FILE = "index.jsonl"
+	// INDEX_VERSION must be raised whenever what is indexed for an entry
+	// changes, so pages indexed by an older version are indexed again.
+	INDEX_VERSION = 5
+)
+
+// IndexRecord is one line of the event index. Each indexed page starts with a
+// record holding its name and number of entries, followed by a record for each
+// of its entries.
+type IndexRecord struct {
+	Page    string `json:"page"`
+	Version int    `json:"version,omitempty"`
+	Entries int    `json:"entries,omitempty"`
+	// SavedAt is when the page was fetched, unknown for pages indexed after the
+	// fact.
+	SavedAt *time.Time `json:"saved_at,omitempty"`
+
+	MessageId string `json:"id,omitempty"`
+	Time      string `json:"time,omitempty"`
+	// Offset is the position of the entry in the entries of the page.
+	Offset int `json:"offset,omitempty"`
+	// Next is the time of the entry that follows in the page, the continuation
+	// chain used to pick the next cursor.
+	Next  string      `json:"next,omitempty"`
+	Media []MediaUnit `json:"media,omitempty"`
+}
+
+func (record *IndexRecord) isPageStart() bool {
+	return record.Time == ""
+}
+
+// EventIndex maps every archived message to the event page holding it, so
+// the archive can be resumed without reading the pages. Pages are keyed by
+// their name without the .gz of compressed pages.
+type EventIndex struct {
+	journal journal
+	mutex   sync.Mutex
+	pages   map[string][]IndexRecord
+	savedAt map[string]time.Time
+	byId    map[string]IndexRecord
+	// stale is set when the file holds pages that were indexed again, or by an
+	// older version, and should be rewritten.
+	stale bool
+}
+
+func pageKey(name string) string {
+	return strings.TrimSuffix(name, ".gz")
+}
+
+func loadEventIndex(journal journal) (*EventIndex, error) {
+	index := EventIndex{
+		journal: journal,
+		pages:   make(map[string][]IndexRecord),
+		savedAt: make(map[string]time.Time),
+		byId:    make(map[string]IndexRecord),
+	}
+
+	content, err := journal.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event index: %w", err)
+	}
+
+	var page *IndexRecord
+	var records []IndexRecord
+	// A page is only indexed once all of its records were written.
+	flush := func() {
+		if page == nil {
+			return
+		}
+		if page.Version != INDEX_VERSION || len(records) != page.Entries {
+			index.stale = true
+			return
+		}
+		if _, ok := index.pages[page.Page]; ok {
+			index.stale = true
+		}
+		index.pages[page.Page] = records
+		if page.SavedAt != nil {
+			index.savedAt[page.Page] = *page.SavedAt
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record IndexRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// Most likely the last line, cut short when a run stopped.
+			index.stale = true
+			break
+		}
+		if record.isPageStart() {
+			flush()
+			page = &record
+			records = make([]IndexRecord, 0, record.Entries)
+			continue
+		}
+		if page != nil && record.Page == page.Page {
+			records = append(records, record)
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read event index %s: %w", journal.Location(), err)
+	}
+
+	index.mapIds()
+	return &index, nil
+}
+
+// mapIds maps every message to the last page holding it.
+func (index *EventIndex) mapIds() {
+	index.byId = make(map[string]IndexRecord)
+	for _, key := range index.pageKeys() {
+		for _, record := range index.pages[key] {
+			index.byId[record.MessageId] = record
+		}
+	}
+}
+
+func (index *EventIndex) pageKeys() []string {
+	keys := make([]string, 0, len(index.pages))
+	for key := range index.pages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (index *EventIndex) HasPage(name string) bool {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	_, ok := index.pages[pageKey(name)]
+	return ok
+}
+
+// Lookup returns where the message with the given id is stored.
+func (index *EventIndex) Lookup(messageId string) (IndexRecord, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	record, ok := index.byId[messageId]
+	return record, ok
+}
+
+// Count returns the number of distinct indexed messages.
+func (index *EventIndex) Count() int {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return len(index.byId)
+}
+
+// InRange returns the records of the distinct indexed messages sent between
+// from and to, both included, as millisecond timestamps.
+func (index *EventIndex) InRange(from int64, to int64) []IndexRecord {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	records := make([]IndexRecord, 0)
+	for _, record := range index.byId {
+		t, err := strconv.ParseInt(record.Time, 10, 64)
+		if err == nil && t >= from && t <= to {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// PageSavedAt returns when a page was fetched, or the zero time when unknown.
+func (index *EventIndex) PageSavedAt(name string) time.Time {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return index.savedAt[pageKey(name)]
+}
+
+func (index *EventIndex) pageStart(key string) IndexRecord {
+	record := IndexRecord{Page: key, Version: INDEX_VERSION, Entries: len(index.pages[key])}
+	if savedAt, ok := index.savedAt[key]; ok {
+		record.SavedAt = &savedAt
+	}
+	return record
+}
+
+// Records returns the records of every indexed entry, page by page.
+func (index *EventIndex) Records() []IndexRecord {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	records := make([]IndexRecord, 0, len(index.byId))
+	for _, key := range index.pageKeys() {
+		records = append(records, index.pages[key]...)
+	}
+	return records
+}
+
+func indexEvent(key string, event twitter.ConversationResponse) []IndexRecord {
+	entries := event.GetEntries()
+	records := make([]IndexRecord, 0, len(entries))
+	for i, entry := range entries {
+		record := IndexRecord{
+			Page:      key,
+			MessageId: entryKey(entry),
+			Time:      entry.Message.Time,
+			Offset:    i,
+			Media:     mediaUnitsFromEntry(entry, event.ConversationTimeline.Users),
+		}
+		if i+1 < len(entries) {
+			record.Next = entries[i+1].Message.Time
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// AddPage indexes the entries of a saved event page, replacing what was indexed
+// for it before. savedAt is the zero time for pages fetched by older versions.
+func (index *EventIndex) AddPage(name string, event twitter.ConversationResponse, savedAt time.Time) error {
+	key := pageKey(name)
+	records := indexEvent(key, event)
+
+	var content bytes.Buffer
+	start := IndexRecord{Page: key, Version: INDEX_VERSION, Entries: len(records)}
+	if !savedAt.IsZero() {
+		start.SavedAt = &savedAt
+	}
+	err := encodePage(&content, start, records)
+	if err != nil {
+		return err
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	err = index.journal.Append(content.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to append to event index: %w", err)
+	}
+
+	_, replaced := index.pages[key]
+	index.pages[key] = records
+	if savedAt.IsZero() {
+		delete(index.savedAt, key)
+	} else {
+		index.savedAt[key] = savedAt
+	}
+	if replaced {
+		// Messages only the older copy held are not stored anymore.
+		index.stale = true
+		index.mapIds()
+		return nil
+	}
+	for _, record := range records {
+		index.byId[record.MessageId] = record
+	}
+	return nil
+}
+
+// UpdateMedia replaces what is indexed as the media of a message, such as with
+// the media re-fetched with fresh URLs, so later runs start from them. Every
+// page holding the message is indexed again.
+func (index *EventIndex) UpdateMedia(messageId string, media []MediaUnit) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	var content bytes.Buffer
+	for _, key := range index.pageKeys() {
+		records := index.pages[key]
+		changed := false
+		for i := range records {
+			if records[i].MessageId == messageId && !reflect.DeepEqual(records[i].Media, media) {
+				records[i].Media = media
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		err := encodePage(&content, index.pageStart(key), records)
+		if err != nil {
+			return err
+		}
+	}
+	if content.Len() == 0 {
+		return nil
+	}
+
+	err := index.journal.Append(content.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to append to event index: %w", err)
+	}
+	index.stale = true
+	index.mapIds()
+	return nil
+}
+
+func encodePage(content *bytes.Buffer, start IndexRecord, records []IndexRecord) error {
+	encoder := json.NewEncoder(content)
+	err := encoder.Encode(start)
+	for i := 0; err == nil && i < len(records); i++ {
+		err = encoder.Encode(records[i])
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode event index: %w", err)
+	}
+	return nil
+}
+
+// RemoveMissingPages drops the pages that are not stored anymore, which happens
+// when an archive file lost the pages written by a run that stopped. It returns
+// how many pages were dropped.
+func (index *EventIndex) RemoveMissingPages(stored []string) int {
+	storedKeys := make(map[string]bool, len(stored))
+	for _, name := range stored {
+		storedKeys[pageKey(name)] = true
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	removed := 0
+	for key := range index.pages {
+		if storedKeys[key] {
+			continue
+		}
+		delete(index.pages, key)
+		delete(index.savedAt, key)
+		removed++
+	}
+	if removed > 0 {
+		index.mapIds()
+		index.stale = true
+	}
+	return removed
+}
+
+// Compact rewrites the index without the superseded pages, if there are any.
+func (index *EventIndex) Compact() error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if !index.stale {
+		return nil
+	}
+
+	var content bytes.Buffer
+	for _, key := range index.pageKeys() {
+		err := encodePage(&content, index.pageStart(key), index.pages[key])
+		if err != nil {
+			return err
+		}
+	}
+	if err := index.journal.Replace(content.Bytes()); err != nil {
+		return fmt.Errorf("failed to replace event index: %w", err)
+	}
+	index.stale = false
+	return nil
+}
+
+// syncIndex indexes the event pages that are not indexed yet, which are all of
+// them the first time, and then only the pages saved by older versions. Pages
+// the storage does not hold anymore are dropped from the index.
+func (dlManager *DLManager) syncIndex() error {
+	names, err := dlManager.eventPageNames()
+	if err != nil {
+		return err
+	}
+	if removed := dlManager.Index.RemoveMissingPages(names); removed > 0 {
+		logger.EventsLogger.Printf("Dropped %d indexed event pages that are not stored anymore\n", removed)
+	}
+	for _, name := range names {
+		if dlManager.Index.HasPage(name) {
+			continue
+		}
+		event, err := dlManager.readEvent(name)
+		if err != nil {
+			return err
+		}
+		err = dlManager.Index.AddPage(name, *event, time.Time{})
+		if err != nil {
+			return err
+		}
+	}
+	return dlManager.Index.Compact()
+}
+
+// loadFromIndex restores the continuation chain and the pending media from the
+// index instead of the event pages.
+func (dlManager *DLManager) loadFromIndex() {
+	collector := newEntryCollector()
+	seen := make(map[string]bool)
+	for _, record := range dlManager.Index.Records() {
+		collector.link(record.Time, record.Next)
+		if seen[record.MessageId] {
+			continue
+		}
+		seen[record.MessageId] = true
+		for _, unit := range dlManager.selectMedia(record.Media) {
+			if dlManager.isMediaTypeEnabled(unit.MediaType) {
+				dlManager.PendingMedia = append(dlManager.PendingMedia, unit)
+			}
+		}
+	}
+	dlManager.EntriesContMap = collector.ContMap
+}
+
+// storedPageName finds under which name an indexed page is stored, which may
+// have been compressed since it was indexed.
+func (dlManager *DLManager) storedPageName(key string) string {
+	if !dlManager.Storage.Exists(key) && dlManager.Storage.Exists(key+".gz") {
+		return key + ".gz"
+	}
+	return key
+}
+
+// ReadIndexedEntry reads a single entry from the page the index points to.
+func (dlManager *DLManager) ReadIndexedEntry(record IndexRecord) (*twitter.Entry, error) {
+	name := dlManager.storedPageName(record.Page)
+	event, err := dlManager.readEvent(name)
+	if err != nil {
+		return nil, err
+	}
+	entries := event.GetEntries()
+	if record.Offset >= len(entries) || entryKey(entries[record.Offset]) != record.MessageId {
+		return nil, fmt.Errorf("entry %s is not at position %d of %s anymore, the index is outdated", record.MessageId, record.Offset, name)
+	}
+	return &entries[record.Offset], nil
+}
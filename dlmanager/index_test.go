@@ -0,0 +1,138 @@
+package dlmanager
+
+import (
+	"XDMArchiver/twitter"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMessage(id string, timestamp string, photoURL string) twitter.Entry {
+	message := twitter.Message{
+		EntryHeader: twitter.EntryHeader{ID: id, Time: timestamp},
+		MessageData: twitter.MessageData{ID: id, Time: timestamp, SenderID: "5", Text: "message " + id},
+	}
+	if photoURL != "" {
+		message.MessageData.Attachment = &twitter.Attachment{
+			Photo: twitter.Photo{IDStr: id + "0", MediaURLHTTPS: photoURL},
+		}
+	}
+	return twitter.Entry{Type: "message", Message: &message}
+}
+
+func testPage(entries ...twitter.Entry) twitter.ConversationResponse {
+	return twitter.ConversationResponse{ConversationTimeline: twitter.ConversationTimeline{Entries: entries}}
+}
+
+func openTestIndex(t *testing.T, path string) *EventIndex {
+	t.Helper()
+	index, err := loadEventIndex(&fileJournal{Path: path})
+	if err != nil {
+		t.Fatalf("loadEventIndex failed: %v", err)
+	}
+	return index
+}
+
+func mustAddPage(t *testing.T, index *EventIndex, name string, event twitter.ConversationResponse) {
+	t.Helper()
+	if err := index.AddPage(name, event, time.Now().UTC()); err != nil {
+		t.Fatalf("AddPage(%s) failed: %v", name, err)
+	}
+}
+
+func TestEventIndexUpdateMedia(t *testing.T) {
+	path := filepath.Join(t.TempDir(), INDEX_FILE)
+	index := openTestIndex(t, path)
+	expired := testMessage("10", "1000", "https://pbs.twimg.com/dm/10/expired.jpg")
+	mustAddPage(t, index, "events/1.json", testPage(expired, testMessage("11", "1001", "")))
+	mustAddPage(t, index, "events/2.json", testPage(expired))
+
+	fresh := mediaUnitsFromEntry(testMessage("10", "1000", "https://pbs.twimg.com/dm/10/fresh.jpg"), nil)
+	if err := index.UpdateMedia("10", fresh); err != nil {
+		t.Fatalf("UpdateMedia failed: %v", err)
+	}
+
+	for _, index := range []*EventIndex{index, openTestIndex(t, path)} {
+		for _, record := range index.Records() {
+			if record.MessageId == "10" && (len(record.Media) != 1 || record.Media[0].URL != fresh[0].URL) {
+				t.Errorf("media of message 10 in %s = %+v, want %+v", record.Page, record.Media, fresh)
+			}
+		}
+		if record, _ := index.Lookup("11"); record.Page != "events/1.json" {
+			t.Errorf("message 11 is indexed in %q, want events/1.json", record.Page)
+		}
+	}
+}
+
+func TestLoadEventIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(content string) string
+		pages  []string
+	}{
+		{"intact", func(content string) string { return content }, []string{"events/1.json", "events/2.json"}},
+		{"last line cut short", func(content string) string { return content[:len(content)-10] }, []string{"events/1.json"}},
+		{"last page missing records", func(content string) string {
+			lines := strings.SplitAfter(content, "\n")
+			return strings.Join(lines[:len(lines)-2], "")
+		}, []string{"events/1.json"}},
+		{"older version", func(content string) string {
+			return strings.Replace(content, fmt.Sprintf(`"version":%d`, INDEX_VERSION), fmt.Sprintf(`"version":%d`, INDEX_VERSION-1), 1)
+		}, []string{"events/2.json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), INDEX_FILE)
+			index := openTestIndex(t, path)
+			mustAddPage(t, index, "events/1.json", testPage(testMessage("11", "1001", ""), testMessage("10", "1000", "")))
+			mustAddPage(t, index, "events/2.json", testPage(testMessage("13", "1003", ""), testMessage("12", "1002", "")))
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read index: %v", err)
+			}
+			damaged := test.damage(string(content))
+			if err := os.WriteFile(path, []byte(damaged), 0644); err != nil {
+				t.Fatalf("failed to write index: %v", err)
+			}
+
+			index = openTestIndex(t, path)
+			if pages := index.pageKeys(); !reflect.DeepEqual(pages, test.pages) {
+				t.Errorf("indexed pages = %v, want %v", pages, test.pages)
+			}
+			if want := 2 * len(test.pages); index.Count() != want {
+				t.Errorf("Count() = %d, want %d", index.Count(), want)
+			}
+			if stale := damaged != string(content); index.stale != stale {
+				t.Errorf("stale = %v, want %v", index.stale, stale)
+			}
+		})
+	}
+}
+
+func TestEventIndexAddPageReplaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), INDEX_FILE)
+	index := openTestIndex(t, path)
+	mustAddPage(t, index, "events/1.json", testPage(testMessage("11", "1001", ""), testMessage("10", "1000", "")))
+	mustAddPage(t, index, "events/1.json.gz", testPage(testMessage("12", "1002", ""), testMessage("11", "1001", "")))
+
+	for _, index := range []*EventIndex{index, openTestIndex(t, path)} {
+		if pages := index.pageKeys(); !reflect.DeepEqual(pages, []string{"events/1.json"}) {
+			t.Errorf("indexed pages = %v, want [events/1.json]", pages)
+		}
+		if _, ok := index.Lookup("10"); ok {
+			t.Errorf("message 10 is still indexed after its page was replaced")
+		}
+		for _, id := range []string{"11", "12"} {
+			if _, ok := index.Lookup(id); !ok {
+				t.Errorf("message %s is not indexed", id)
+			}
+		}
+		if !index.stale {
+			t.Errorf("the index holding a replaced page is not marked to be rewritten")
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package dlmanager
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// JOURNAL_DIR holds the bookkeeping files of encrypted archives inside the
+	// storage, so they are sealed like the events and media.
+	JOURNAL_DIR = "journal"
+
+	journalSnapshotSuffix = ".snapshot.jsonl"
+	journalAppendSuffix   = ".jsonl"
+)
+
+// journal is where a JSONL bookkeeping file is kept: a regular file in the
+// conversation directory, or a sequence of files in the storage.
+type journal interface {
+	// Read returns the whole content, nil when there is none yet.
+	Read() ([]byte, error)
+	Append(data []byte) error
+	// Replace rewrites the whole content, removing it when data is empty.
+	Replace(data []byte) error
+	// Location tells the user where to find the content.
+	Location() string
+}
+
+// openJournal returns where the given bookkeeping file is kept: sealed in the
+// storage for encrypted archives, next to the archive otherwise.
+func openJournal(options Options, conversationPath string, storage Storage, file string) (journal, error) {
+	plain := &fileJournal{Path: filepath.Join(conversationPath, file)}
+	if !options.Encrypt {
+		return plain, nil
+	}
+	sealed, err := newStorageJournal(storage, file)
+	if err != nil {
+		return nil, err
+	}
+	err = sealed.importFile(plain)
+	if err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// fileJournal keeps the content in a regular file.
+type fileJournal struct {
+	Path string
+}
+
+func (journal *fileJournal) Read() ([]byte, error) {
+	data, err := os.ReadFile(journal.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", journal.Path, err)
+	}
+	return data, nil
+}
+
+func (journal *fileJournal) Append(data []byte) error {
+	err := os.MkdirAll(filepath.Dir(journal.Path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.OpenFile(journal.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", journal.Path, err)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to append to %s: %w", journal.Path, err)
+	}
+	return nil
+}
+
+func (journal *fileJournal) Replace(data []byte) error {
+	if len(data) == 0 {
+		err := os.Remove(journal.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", journal.Path, err)
+		}
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(journal.Path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmpPath := journal.Path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	err = os.Rename(tmpPath, journal.Path)
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", journal.Path, err)
+	}
+	return nil
+}
+
+func (journal *fileJournal) Location() string {
+	return journal.Path
+}
+
+// storageJournal keeps the content in numbered files of the storage, since
+// files cannot be appended to there. Every append adds a file, and a rewrite
+// adds a snapshot that the files before it are ignored for. They are removed
+// where the storage allows it.
+type storageJournal struct {
+	storage  Storage
+	name     string
+	sequence int
+	// files are the names of the files read from the last snapshot on, and
+	// obsolete the files before it.
+	files    []string
+	obsolete []string
+}
+
+func newStorageJournal(storage Storage, file string) (*storageJournal, error) {
+	journal := storageJournal{storage: storage, name: path.Join(JOURNAL_DIR, file)}
+	names, err := storage.List(journal.name + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", journal.name, err)
+	}
+	numbers := make(map[string]int, len(names))
+	for _, name := range names {
+		base := strings.TrimSuffix(strings.TrimSuffix(path.Base(name), journalSnapshotSuffix), journalAppendSuffix)
+		number, err := strconv.Atoi(base)
+		if err == nil {
+			numbers[name] = number
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return numbers[names[i]] < numbers[names[j]]
+	})
+	for _, name := range names {
+		number, ok := numbers[name]
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(name, journalSnapshotSuffix) {
+			journal.obsolete = append(journal.obsolete, journal.files...)
+			journal.files = nil
+		}
+		journal.files = append(journal.files, name)
+		journal.sequence = number
+	}
+	return &journal, nil
+}
+
+func (journal *storageJournal) Read() ([]byte, error) {
+	var content bytes.Buffer
+	for _, name := range journal.files {
+		data, err := journal.storage.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		content.Write(data)
+	}
+	if content.Len() == 0 {
+		return nil, nil
+	}
+	return content.Bytes(), nil
+}
+
+func (journal *storageJournal) put(data []byte, suffix string) (string, error) {
+	name := fmt.Sprintf("%s/%010d%s", journal.name, journal.sequence+1, suffix)
+	err := journal.storage.Put(name, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	journal.sequence++
+	return name, nil
+}
+
+func (journal *storageJournal) Append(data []byte) error {
+	name, err := journal.put(data, journalAppendSuffix)
+	if err != nil {
+		return err
+	}
+	journal.files = append(journal.files, name)
+	return nil
+}
+
+func (journal *storageJournal) Replace(data []byte) error {
+	if len(data) == 0 && len(journal.files) == 0 {
+		return nil
+	}
+	name, err := journal.put(data, journalSnapshotSuffix)
+	if err != nil {
+		return err
+	}
+	journal.obsolete = append(journal.obsolete, journal.files...)
+	journal.files = []string{name}
+	if canDelete(journal.storage) {
+		for _, obsolete := range journal.obsolete {
+			journal.storage.Delete(obsolete)
+		}
+		journal.obsolete = nil
+	}
+	return nil
+}
+
+func (journal *storageJournal) Location() string {
+	return journal.name + " in the encrypted archive"
+}
+
+// importFile moves a bookkeeping file written in plain text by older versions
+// into the journal, unless the journal already holds content.
+func (journal *storageJournal) importFile(plain *fileJournal) error {
+	data, err := plain.Read()
+	if err != nil || data == nil {
+		return err
+	}
+	if len(journal.files) == 0 {
+		err = journal.Replace(data)
+		if err != nil {
+			return err
+		}
+	}
+	return plain.Replace(nil)
+}
@@ -0,0 +1,241 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	LOCK_FILE = ".lock"
+	// LOCK_ATTEMPTS bounds how often acquiring starts over after losing a race.
+	LOCK_ATTEMPTS = 5
+	// LOCK_WRITE_GRACE is how long an unreadable lock file is assumed to be
+	// still being written before it is considered corrupt.
+	LOCK_WRITE_GRACE = 5 * time.Second
+	// CORRUPT_LOCK_PID is the owner pid reported for unreadable lock files.
+	CORRUPT_LOCK_PID = -1
+)
+
+// LockInfo is the content of the advisory lock file that marks a conversation
+// directory as being in use by a running archiver.
+type LockInfo struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type ErrLocked struct {
+	Path  string
+	Owner LockInfo
+}
+
+func (err *ErrLocked) Error() string {
+	return fmt.Sprintf("conversation directory is locked by pid %d on host %s since %s (lock file %s)",
+		err.Owner.PID, err.Owner.Host, err.Owner.StartedAt.Local().Format(time.DateTime), err.Path)
+}
+
+type ConversationLock struct {
+	Path string
+	Info LockInfo
+}
+
+func AcquireLock(dir string) (*ConversationLock, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return acquireLock(dir, LockInfo{
+		PID:       os.Getpid(),
+		Host:      host,
+		StartedAt: time.Now(),
+	})
+}
+
+func acquireLock(dir string, info LockInfo) (*ConversationLock, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	lock := ConversationLock{Path: filepath.Join(dir, LOCK_FILE), Info: info}
+
+	// The lock can change hands between each step, for instance when it
+	// disappears before it is read or another process takes over the same
+	// stale lock, so every step that loses a race starts over.
+	owner := &LockInfo{}
+	for attempt := 0; attempt < LOCK_ATTEMPTS; attempt++ {
+		err = lock.create()
+		if err == nil {
+			return &lock, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file %s: %w", lock.Path, err)
+		}
+
+		var stat os.FileInfo
+		owner, stat, err = readLockInfo(lock.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			owner = &LockInfo{}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !lock.isStale(owner) {
+			return nil, &ErrLocked{Path: lock.Path, Owner: *owner}
+		}
+		logger.EventsLogger.Printf("Taking over stale lock of pid %d on host %s\n", owner.PID, owner.Host)
+		err = lock.takeOver(owner, stat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, &ErrLocked{Path: lock.Path, Owner: *owner}
+}
+
+// create writes the lock to a file of its own and links it into place, so the
+// lock file never exists without its content. Another process could otherwise
+// read it empty and take it for a stale lock.
+func (lock *ConversationLock) create() error {
+	tmpPath := fmt.Sprintf("%s.%d.tmp", lock.Path, lock.Info.PID)
+	content, err := json.Marshal(lock.Info)
+	if err != nil {
+		return fmt.Errorf("failed to encode lock file: %w", err)
+	}
+	err = os.WriteFile(tmpPath, content, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	return linkLockFile(tmpPath, content, lock.Path)
+}
+
+// linkLockFile puts the content of path at lockPath, failing with os.ErrExist
+// when lockPath exists. Filesystems without hard links, such as exFAT and some
+// network shares, get the file written in place instead, which readers allow
+// for with LOCK_WRITE_GRACE.
+func linkLockFile(path string, content []byte, lockPath string) error {
+	err := os.Link(path, lockPath)
+	if err == nil || errors.Is(err, os.ErrExist) {
+		return err
+	}
+	file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	return nil
+}
+
+// takeOver removes the given stale lock. Removing the lock file directly could
+// remove the lock another process has just created after taking over the same
+// stale lock, so the lock file is moved aside first and only deleted when it
+// is still the stale one. Otherwise it is put back.
+func (lock *ConversationLock) takeOver(stale *LockInfo, staleStat os.FileInfo) error {
+	movedPath := fmt.Sprintf("%s.%d.%d.stale", lock.Path, lock.Info.PID, time.Now().UnixNano())
+	err := os.Rename(lock.Path, movedPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move stale lock file %s: %w", lock.Path, err)
+	}
+	defer os.Remove(movedPath)
+
+	moved, movedStat, err := readLockInfo(movedPath)
+	if err != nil {
+		return err
+	}
+	// Comparing the content too guards against the file system reusing the
+	// identity of a stale lock file that was removed meanwhile.
+	if os.SameFile(movedStat, staleStat) && sameOwner(moved, stale) {
+		return nil
+	}
+	content, err := os.ReadFile(movedPath)
+	if err != nil {
+		return fmt.Errorf("failed to read lock file %s: %w", movedPath, err)
+	}
+	err = linkLockFile(movedPath, content, lock.Path)
+	if errors.Is(err, os.ErrExist) {
+		logger.EventsLogger.Printf("Lock of pid %d on host %s was replaced while taking over a stale lock\n", moved.PID, moved.Host)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore lock file %s: %w", lock.Path, err)
+	}
+	return nil
+}
+
+func sameOwner(a *LockInfo, b *LockInfo) bool {
+	return a.PID == b.PID && a.Host == b.Host && a.StartedAt.Equal(b.StartedAt)
+}
+
+// isStale reports whether the owner of an existing lock is known to be gone.
+// Liveness can only be checked for processes on this host; locks held from
+// other hosts are always respected.
+func (lock *ConversationLock) isStale(owner *LockInfo) bool {
+	if owner.Host != lock.Info.Host {
+		return false
+	}
+	if owner.PID == CORRUPT_LOCK_PID {
+		return time.Since(owner.StartedAt) >= LOCK_WRITE_GRACE
+	}
+	if owner.PID == lock.Info.PID {
+		return true
+	}
+	return !processAlive(owner.PID)
+}
+
+func (lock *ConversationLock) Release() error {
+	owner, _, err := readLockInfo(lock.Path)
+	if err != nil {
+		return err
+	}
+	if owner.PID != lock.Info.PID || owner.Host != lock.Info.Host {
+		return fmt.Errorf("lock file %s is no longer owned by this process", lock.Path)
+	}
+	err = os.Remove(lock.Path)
+	if err != nil {
+		return fmt.Errorf("failed to remove lock file %s: %w", lock.Path, err)
+	}
+	return nil
+}
+
+// readLockInfo reads the owner of a lock file together with the identity of
+// the file it was read from.
+func readLockInfo(path string) (*LockInfo, os.FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read lock file %s: %w", path, err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read lock file %s: %w", path, err)
+	}
+	bytes, err := io.ReadAll(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read lock file %s: %w", path, err)
+	}
+	var info LockInfo
+	err = json.Unmarshal(bytes, &info)
+	if err != nil {
+		// Unreadable locks are treated as owned by a dead local process once
+		// they are old enough to not be still being written.
+		host, _ := os.Hostname()
+		return &LockInfo{PID: CORRUPT_LOCK_PID, Host: host, StartedAt: stat.ModTime()}, stat, nil
+	}
+	return &info, stat, nil
+}
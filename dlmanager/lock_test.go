@@ -0,0 +1,158 @@
+package dlmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A pid far above any pid limit, so no process is running with it.
+const deadPID = 0x7ffffff0
+
+func lockOwner(t *testing.T, pid int) LockInfo {
+	t.Helper()
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return LockInfo{PID: pid, Host: host, StartedAt: time.Now()}
+}
+
+func writeLockFile(t *testing.T, dir string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, LOCK_FILE), content, 0644); err != nil {
+		t.Fatalf("failed to write lock file: %v", err)
+	}
+}
+
+func writeLockOwner(t *testing.T, dir string, owner LockInfo) {
+	t.Helper()
+	content, err := json.Marshal(owner)
+	if err != nil {
+		t.Fatalf("failed to encode lock file: %v", err)
+	}
+	writeLockFile(t, dir, content)
+}
+
+// expectOnlyLock checks that the lock file of the given owner is the only file
+// left in the directory.
+func expectOnlyLock(t *testing.T, dir string, owner LockInfo) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != LOCK_FILE {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory holds %v, want only %s", names, LOCK_FILE)
+	}
+	stored, _, err := readLockInfo(filepath.Join(dir, LOCK_FILE))
+	if err != nil {
+		t.Fatalf("failed to read lock file: %v", err)
+	}
+	if !sameOwner(stored, &owner) {
+		t.Errorf("lock file is owned by %+v, want %+v", *stored, owner)
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	self := lockOwner(t, os.Getpid())
+	tests := []struct {
+		name   string
+		setup  func(t *testing.T, dir string)
+		locked bool
+	}{
+		{"no lock", func(t *testing.T, dir string) {}, false},
+		{"live lock", func(t *testing.T, dir string) {
+			writeLockOwner(t, dir, lockOwner(t, os.Getppid()))
+		}, true},
+		{"live lock of another host", func(t *testing.T, dir string) {
+			writeLockOwner(t, dir, LockInfo{PID: deadPID, Host: "other-host", StartedAt: time.Now()})
+		}, true},
+		{"stale lock", func(t *testing.T, dir string) {
+			writeLockOwner(t, dir, lockOwner(t, deadPID))
+		}, false},
+		{"corrupt lock", func(t *testing.T, dir string) {
+			writeLockFile(t, dir, []byte(`{"pid":`))
+			old := time.Now().Add(-2 * LOCK_WRITE_GRACE)
+			os.Chtimes(filepath.Join(dir, LOCK_FILE), old, old)
+		}, false},
+		{"lock being written", func(t *testing.T, dir string) {
+			writeLockFile(t, dir, nil)
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			test.setup(t, dir)
+			before, _ := os.ReadFile(filepath.Join(dir, LOCK_FILE))
+
+			lock, err := acquireLock(dir, self)
+			if test.locked {
+				var locked *ErrLocked
+				if !errors.As(err, &locked) {
+					t.Fatalf("acquireLock = %v, want %T", err, locked)
+				}
+				after, _ := os.ReadFile(filepath.Join(dir, LOCK_FILE))
+				if string(after) != string(before) {
+					t.Errorf("the held lock was changed from %q to %q", before, after)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("acquireLock failed: %v", err)
+			}
+			expectOnlyLock(t, dir, self)
+			if err := lock.Release(); err != nil {
+				t.Fatalf("Release failed: %v", err)
+			}
+			if _, err := os.Stat(lock.Path); !os.IsNotExist(err) {
+				t.Errorf("the lock file was left behind")
+			}
+		})
+	}
+}
+
+func TestAcquireLockRace(t *testing.T) {
+	// Both owners are live processes, so whoever loses must not take the lock
+	// over from the winner, even when both found the same stale lock.
+	owners := []LockInfo{lockOwner(t, os.Getpid()), lockOwner(t, os.Getppid())}
+	for round := 0; round < 50; round++ {
+		dir := t.TempDir()
+		writeLockOwner(t, dir, lockOwner(t, deadPID))
+
+		locks := make([]*ConversationLock, len(owners))
+		errs := make([]error, len(owners))
+		var wait sync.WaitGroup
+		for i := range owners {
+			wait.Add(1)
+			go func(i int) {
+				defer wait.Done()
+				locks[i], errs[i] = acquireLock(dir, owners[i])
+			}(i)
+		}
+		wait.Wait()
+
+		winners := 0
+		for i, err := range errs {
+			var locked *ErrLocked
+			switch {
+			case err == nil:
+				winners++
+				expectOnlyLock(t, dir, owners[i])
+			case !errors.As(err, &locked):
+				t.Fatalf("round %d: acquireLock failed: %v", round, err)
+			}
+		}
+		if winners != 1 {
+			t.Fatalf("round %d: %d processes acquired the lock, want 1", round, winners)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package dlmanager
+
+import (
+	"os"
+)
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	// FindProcess opens a handle to the process on Windows, which fails when
+	// no process with that pid exists.
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
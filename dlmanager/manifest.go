@@ -0,0 +1,163 @@
+package dlmanager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MANIFEST_FILE = "manifest.jsonl"
+)
+
+// ManifestRecord links a downloaded media file to the message it belongs to.
+type ManifestRecord struct {
+	MessageId    string    `json:"message_id"`
+	SenderId     string    `json:"sender_id"`
+	MediaType    string    `json:"media_type"`
+	SourceURL    string    `json:"source_url"`
+	Bitrate      int       `json:"bitrate,omitempty"`
+	DurationMs   int       `json:"duration_ms,omitempty"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+	// ContentType is the type of the video variant that was downloaded, and
+	// VideoQuality the policy it was picked with.
+	ContentType  string `json:"content_type,omitempty"`
+	VideoQuality string `json:"video_quality,omitempty"`
+	// StreamURL, Resolution and Segments describe the stream picked from an
+	// HLS playlist and how many segments were joined.
+	StreamURL  string `json:"stream_url,omitempty"`
+	Resolution string `json:"resolution,omitempty"`
+	Segments   int    `json:"segments,omitempty"`
+}
+
+// Manifest is an append-only JSONL file of ManifestRecord. A file that is
+// downloaded again gets a new line, and the last line for a path wins.
+type Manifest struct {
+	journal journal
+	mutex   sync.Mutex
+	records map[string]ManifestRecord
+}
+
+func loadManifest(journal journal) (*Manifest, error) {
+	manifest := Manifest{
+		journal: journal,
+		records: make(map[string]ManifestRecord),
+	}
+
+	content, err := journal.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	path := journal.Location()
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record ManifestRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to json decode line %d of %s: %w", line, path, err)
+		}
+		manifest.records[record.Path] = record
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", path, err)
+	}
+
+	return &manifest, nil
+}
+
+func (manifest *Manifest) Get(path string) (ManifestRecord, bool) {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+	record, ok := manifest.records[path]
+	return record, ok
+}
+
+// Records returns every record ordered by message id and path.
+func (manifest *Manifest) Records() []ManifestRecord {
+	manifest.mutex.Lock()
+	records := make([]ManifestRecord, 0, len(manifest.records))
+	for _, record := range manifest.records {
+		records = append(records, record)
+	}
+	manifest.mutex.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].MessageId != records[j].MessageId {
+			return records[i].MessageId < records[j].MessageId
+		}
+		return records[i].Path < records[j].Path
+	})
+	return records
+}
+
+// ByMessage groups the records by message id, each group ordered by path.
+func (manifest *Manifest) ByMessage() map[string][]ManifestRecord {
+	byMessage := make(map[string][]ManifestRecord)
+	for _, record := range manifest.Records() {
+		byMessage[record.MessageId] = append(byMessage[record.MessageId], record)
+	}
+	return byMessage
+}
+
+func (manifest *Manifest) Add(record ManifestRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest record: %w", err)
+	}
+
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+	err = manifest.journal.Append(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to append to manifest: %w", err)
+	}
+	manifest.records[record.Path] = record
+	return nil
+}
+
+// Rename moves the record of a file to a new path and rewrites the manifest.
+func (manifest *Manifest) Rename(oldPath string, newPath string) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	record, ok := manifest.records[oldPath]
+	if !ok {
+		return nil
+	}
+	delete(manifest.records, oldPath)
+	record.Path = newPath
+	manifest.records[newPath] = record
+	return manifest.save()
+}
+
+func (manifest *Manifest) save() error {
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	for _, record := range manifest.records {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("failed to encode manifest record: %w", err)
+		}
+	}
+	if err := manifest.journal.Replace(content.Bytes()); err != nil {
+		return fmt.Errorf("failed to replace manifest: %w", err)
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
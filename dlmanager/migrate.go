@@ -0,0 +1,118 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/twitter"
+	"XDMArchiver/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type MigrationReport struct {
+	Renamed   int
+	Missing   int
+	Ambiguous []string
+	Failed    map[string]error
+}
+
+func (report *MigrationReport) Print() {
+	logger.MediaLogger.Printf("Renamed %d media files, %d were never downloaded\n", report.Renamed, report.Missing)
+	for _, path := range report.Ambiguous {
+		logger.MediaLogger.Printf("\tLeft %s in place, it is shared by several media\n", path)
+	}
+	for path, err := range report.Failed {
+		logger.MediaLogger.Printf("\tFailed to rename %s: %v\n", path, err)
+	}
+}
+
+// legacyMediaPath is where the media was stored before file names were derived
+// from the message and media ids: named after the message time formatted in the
+// local time zone, including the stray newline after photo names.
+func (dlManager *DLManager) legacyMediaPath(entry twitter.Entry, unit MediaUnit) string {
+	stamp, _ := utils.FormatUnixTimestamp(entry.Message.MessageData.Time, true)
+	if unit.MediaType == "Photo" {
+		return filepath.Join(dlManager.PhotosPath, fmt.Sprintf("%s.jpg\n", stamp))
+	}
+	return filepath.Join(dlManager.VideosPath, fmt.Sprintf("%s-%d.mp4", stamp, unit.Bitrate))
+}
+
+// MigrateLayout renames media stored under legacy file names to the current
+// naming scheme, using the archived events to match files with their media.
+// The manifest and the failures ledger are updated to the new names.
+func (dlManager *DLManager) MigrateLayout() (*MigrationReport, error) {
+	report := MigrationReport{
+		Ambiguous: make([]string, 0),
+		Failed:    make(map[string]error),
+	}
+
+	storage, ok := dlManager.Storage.(*DirStorage)
+	if !ok {
+		return nil, fmt.Errorf("the layout can only be migrated with the %s storage", STORAGE_DIR)
+	}
+	names, err := dlManager.eventPageNames()
+	if err != nil {
+		return nil, err
+	}
+
+	// Legacy names only have a one second resolution, so a legacy file claimed
+	// by several media cannot be attributed to any of them.
+	renames := make(map[string][]MediaUnit)
+	seen := make(map[string]bool)
+	// Legacy versions always downloaded the highest variant.
+	highest := VideoQuality{Policy: QUALITY_HIGHEST}
+	for _, name := range names {
+		event, err := dlManager.readEvent(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range event.GetEntries() {
+			for _, unit := range highest.Select(mediaUnitsFromEntry(entry, event.ConversationTimeline.Users)) {
+				if seen[dlManager.mediaName(unit)] {
+					continue
+				}
+				seen[dlManager.mediaName(unit)] = true
+				legacyPath := dlManager.legacyMediaPath(entry, unit)
+				renames[legacyPath] = append(renames[legacyPath], unit)
+			}
+		}
+	}
+
+	for legacyPath, units := range renames {
+		if !utils.FileExists(legacyPath) {
+			report.Missing += len(units)
+			continue
+		}
+		if len(units) > 1 {
+			report.Ambiguous = append(report.Ambiguous, legacyPath)
+			continue
+		}
+		unit := units[0]
+		newName := dlManager.mediaName(unit)
+		newPath := storage.Path(newName)
+		if utils.FileExists(newPath) {
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(newPath), 0755)
+		if err == nil {
+			err = os.Rename(legacyPath, newPath)
+		}
+		if err != nil {
+			report.Failed[legacyPath] = err
+			continue
+		}
+		report.Renamed++
+
+		legacyName, _ := filepath.Rel(dlManager.ConversationPath, legacyPath)
+		err = dlManager.Manifest.Rename(filepath.ToSlash(legacyName), newName)
+		if err != nil {
+			return nil, err
+		}
+		err = dlManager.Failures.Replace(unit.MediaType, filepath.Base(legacyPath), unit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &report, nil
+}
@@ -0,0 +1,125 @@
+package dlmanager
+
+import (
+	"XDMArchiver/hls"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	QUALITY_HIGHEST     = "highest"
+	QUALITY_LOWEST      = "lowest"
+	QUALITY_MAX_BITRATE = "max-bitrate"
+	QUALITY_ALL         = "all"
+
+	DEFAULT_VIDEO_QUALITY = QUALITY_HIGHEST
+)
+
+// VideoQuality is the policy used to pick which variants of a video are
+// downloaded. MaxBitrate is only set for max-bitrate, which picks the highest
+// variant at or below it, or the lowest one when they are all above it.
+type VideoQuality struct {
+	Policy     string
+	MaxBitrate int
+}
+
+// ParseVideoQuality parses highest, lowest, all or max-bitrate=N.
+func ParseVideoQuality(raw string) (*VideoQuality, error) {
+	switch raw {
+	case QUALITY_HIGHEST, QUALITY_LOWEST, QUALITY_ALL:
+		return &VideoQuality{Policy: raw}, nil
+	}
+	value, ok := strings.CutPrefix(raw, QUALITY_MAX_BITRATE+"=")
+	if !ok {
+		return nil, fmt.Errorf("unknown video quality %s, expected %s, %s, %s=N or %s", raw, QUALITY_HIGHEST, QUALITY_LOWEST, QUALITY_MAX_BITRATE, QUALITY_ALL)
+	}
+	maxBitrate, err := strconv.Atoi(value)
+	if err != nil || maxBitrate <= 0 {
+		return nil, fmt.Errorf("invalid maximum bitrate %s, expected a positive number of bits per second", value)
+	}
+	return &VideoQuality{Policy: QUALITY_MAX_BITRATE, MaxBitrate: maxBitrate}, nil
+}
+
+func (quality *VideoQuality) String() string {
+	if quality.Policy == QUALITY_MAX_BITRATE {
+		return QUALITY_MAX_BITRATE + "=" + strconv.Itoa(quality.MaxBitrate)
+	}
+	return quality.Policy
+}
+
+// prefers tells whether a variant of bitrate a is preferred over one of
+// bitrate b.
+func (quality *VideoQuality) prefers(a int, b int) bool {
+	switch quality.Policy {
+	case QUALITY_LOWEST:
+		return a < b
+	case QUALITY_MAX_BITRATE:
+		aFits, bFits := a <= quality.MaxBitrate, b <= quality.MaxBitrate
+		if aFits != bFits {
+			return aFits
+		}
+		if !aFits {
+			return a < b
+		}
+	}
+	return a > b
+}
+
+// variantGroups splits the media units of a message into the variants of each
+// media, in the order the media come in.
+func variantGroups(units []MediaUnit) [][]MediaUnit {
+	groups := make([][]MediaUnit, 0, len(units))
+	positions := make(map[string]int)
+	for _, unit := range units {
+		key := unit.MediaType + "/" + unit.MediaId
+		position, ok := positions[key]
+		if !ok {
+			position = len(groups)
+			positions[key] = position
+			groups = append(groups, nil)
+		}
+		groups[position] = append(groups[position], unit)
+	}
+	return groups
+}
+
+// preferred sorts the variants of a media from the most to the least
+// preferred.
+func (quality *VideoQuality) preferred(variants []MediaUnit) []MediaUnit {
+	sorted := append([]MediaUnit(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return quality.prefers(sorted[i].Bitrate, sorted[j].Bitrate)
+	})
+	return sorted
+}
+
+// Select keeps the variants of each media that the policy picks: every one of
+// them for all, the most preferred one otherwise.
+func (quality *VideoQuality) Select(units []MediaUnit) []MediaUnit {
+	selected := make([]MediaUnit, 0, len(units))
+	for _, variants := range variantGroups(units) {
+		if quality.Policy == QUALITY_ALL {
+			selected = append(selected, variants...)
+		} else {
+			selected = append(selected, quality.preferred(variants)[0])
+		}
+	}
+	return selected
+}
+
+// selectStream picks the stream of an HLS master playlist. There is a single
+// file for an HLS video, so all picks the highest stream.
+func (quality *VideoQuality) selectStream(variants []hls.Variant) hls.Variant {
+	sorted := append([]hls.Variant(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return quality.prefers(sorted[i].Bandwidth, sorted[j].Bandwidth)
+	})
+	return sorted[0]
+}
+
+// selectMedia keeps the media units of a message picked by the video quality.
+func (dlManager *DLManager) selectMedia(units []MediaUnit) []MediaUnit {
+	return dlManager.Options.VideoQuality.Select(units)
+}
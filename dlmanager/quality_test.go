@@ -0,0 +1,60 @@
+package dlmanager
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func testVariant(mediaId string, bitrate int) MediaUnit {
+	return MediaUnit{
+		URL:       "https://video.twimg.com/dm_video/" + mediaId + "/" + strconv.Itoa(bitrate) + ".mp4",
+		Filename:  mediaId + "_" + strconv.Itoa(bitrate) + ".mp4",
+		MediaType: "Video",
+		MediaId:   mediaId,
+		Bitrate:   bitrate,
+	}
+}
+
+func TestVideoQualitySelect(t *testing.T) {
+	units := []MediaUnit{
+		testVariant("1", 832000), testVariant("1", 256000), testVariant("1", 2176000),
+		{URL: "https://pbs.twimg.com/dm/2.jpg", Filename: "2.jpg", MediaType: "Photo", MediaId: "2"},
+		testVariant("3", 632000),
+	}
+	tests := []struct {
+		quality string
+		want    []string
+	}{
+		{QUALITY_HIGHEST, []string{"1_2176000.mp4", "2.jpg", "3_632000.mp4"}},
+		{QUALITY_LOWEST, []string{"1_256000.mp4", "2.jpg", "3_632000.mp4"}},
+		{QUALITY_MAX_BITRATE + "=1000000", []string{"1_832000.mp4", "2.jpg", "3_632000.mp4"}},
+		{QUALITY_MAX_BITRATE + "=832000", []string{"1_832000.mp4", "2.jpg", "3_632000.mp4"}},
+		// Without a variant under the limit, the lowest one is picked.
+		{QUALITY_MAX_BITRATE + "=100000", []string{"1_256000.mp4", "2.jpg", "3_632000.mp4"}},
+		{QUALITY_ALL, []string{"1_832000.mp4", "1_256000.mp4", "1_2176000.mp4", "2.jpg", "3_632000.mp4"}},
+	}
+	for _, test := range tests {
+		t.Run(test.quality, func(t *testing.T) {
+			quality, err := ParseVideoQuality(test.quality)
+			if err != nil {
+				t.Fatalf("ParseVideoQuality(%q) failed: %v", test.quality, err)
+			}
+			selected := make([]string, 0)
+			for _, unit := range quality.Select(units) {
+				selected = append(selected, unit.Filename)
+			}
+			if !reflect.DeepEqual(selected, test.want) {
+				t.Errorf("Select() = %v, want %v", selected, test.want)
+			}
+		})
+	}
+}
+
+func TestParseVideoQualityRejects(t *testing.T) {
+	for _, raw := range []string{"", "best", QUALITY_MAX_BITRATE, QUALITY_MAX_BITRATE + "=", QUALITY_MAX_BITRATE + "=fast", QUALITY_MAX_BITRATE + "=-1"} {
+		if quality, err := ParseVideoQuality(raw); err == nil {
+			t.Errorf("ParseVideoQuality(%q) = %v, want an error", raw, quality)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/twitter"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// isExpiredMediaError reports whether a failed download looks like the media
+// URL stopped being valid, as opposed to a transient or network failure.
+func isExpiredMediaError(err error) bool {
+	var statusError *twitter.ErrNot200
+	if !errors.As(err, &statusError) {
+		return false
+	}
+	switch statusError.StatusCode {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// refreshMediaUnit re-fetches the page that holds the message owning the media
+// and returns the same media with the URL found in the fresh response.
+func (dlManager *DLManager) refreshMediaUnit(unit MediaUnit) (*MediaUnit, error) {
+	messageId, err := strconv.ParseUint(unit.MessageId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message id %s: %w", unit.MessageId, err)
+	}
+	// Start the page right above the message so it is part of the response
+	// whether max_id is treated as inclusive or exclusive.
+	maxId := strconv.FormatUint(messageId+1, 10)
+	event, _, err := dlManager.TwitterCtx.GetConversation(&maxId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-fetch page of message %s: %w", unit.MessageId, err)
+	}
+
+	for _, entry := range event.GetEntries() {
+		if entry.GetMessageId() != unit.MessageId {
+			continue
+		}
+		media := mediaUnitsFromEntry(entry, event.ConversationTimeline.Users)
+		// The index keeps the fresh URLs, so the next run does not start from
+		// the expired ones again.
+		err = dlManager.Index.UpdateMedia(unit.MessageId, media)
+		if err != nil {
+			logger.MediaLogger.Printf("Failed to index refreshed media of message %s: %v\n", unit.MessageId, err)
+		}
+		var sameType *MediaUnit
+		for _, fresh := range media {
+			if fresh.MediaType != unit.MediaType {
+				continue
+			}
+			if fresh.Filename == unit.Filename {
+				return &fresh, nil
+			}
+			if sameType == nil {
+				sameType = &fresh
+			}
+		}
+		if sameType != nil {
+			return sameType, nil
+		}
+		return nil, fmt.Errorf("message %s no longer has a %s attachment", unit.MessageId, unit.MediaType)
+	}
+
+	return nil, fmt.Errorf("message %s was not found in the re-fetched page", unit.MessageId)
+}
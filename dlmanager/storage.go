@@ -0,0 +1,237 @@
+package dlmanager
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	STORAGE_DIR    = "dir"
+	STORAGE_TAR    = "tar"
+	STORAGE_TAR_GZ = "tar.gz"
+	STORAGE_ZIP    = "zip"
+)
+
+var ErrNotStored = errors.New("not found in storage")
+
+// Storage holds the events and media of one conversation. Names are slash
+// separated paths relative to the conversation directory.
+type Storage interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Exists(name string) bool
+	// List returns the sorted names that start with prefix.
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+	Close() error
+}
+
+// OpenStorage opens the storage backend selected in the options for the
+// conversation, creating it when it does not exist yet. With encryption
+// enabled, the backend is wrapped in an EncryptedStorage.
+func OpenStorage(options Options, conversationId string, conversationPath string) (Storage, error) {
+	if options.Encrypt && options.Dedup {
+		return nil, fmt.Errorf("media deduplication cannot be combined with encryption")
+	}
+	_, err := os.Stat(filepath.Join(conversationPath, KEY_FILE))
+	encrypted := err == nil
+	if encrypted && !options.Encrypt {
+		return nil, fmt.Errorf("conversation %s is encrypted, run again with --encrypt", conversationId)
+	}
+
+	// The key of an encrypted conversation is checked before the backend is
+	// opened, which may write to the archive, so a wrong passphrase changes
+	// nothing.
+	var key []byte
+	if encrypted {
+		key, err = loadArchiveKey(conversationPath, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	storage, err := openBackend(options, conversationId, conversationPath)
+	if err != nil || !options.Encrypt {
+		return storage, err
+	}
+	if !encrypted {
+		names, err := storage.List(EVENTS_DIR + "/")
+		if err == nil && len(names) > 0 {
+			storage.Close()
+			return nil, fmt.Errorf("conversation %s was archived without encryption, it cannot be encrypted in place", conversationId)
+		}
+		key, err = loadArchiveKey(conversationPath, options)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+	encryptedStorage, err := NewEncryptedStorage(storage, key)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return encryptedStorage, nil
+}
+
+func openBackend(options Options, conversationId string, conversationPath string) (Storage, error) {
+	kind := options.Storage
+	if kind == "" {
+		kind = STORAGE_DIR
+	}
+	if kind != STORAGE_DIR && options.Dedup {
+		return nil, fmt.Errorf("media deduplication is only supported with the %s storage", STORAGE_DIR)
+	}
+
+	containerPath := filepath.Join(options.OutputDir, conversationId+"."+kind)
+	if kind != STORAGE_DIR {
+		err := os.MkdirAll(options.OutputDir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	switch kind {
+	case STORAGE_DIR:
+		storage := DirStorage{Root: conversationPath}
+		if options.Dedup {
+			storage.Blobs = NewBlobStore(options.OutputDir)
+		}
+		return &storage, nil
+	case STORAGE_TAR:
+		return OpenTarStorage(containerPath, false)
+	case STORAGE_TAR_GZ:
+		return OpenTarStorage(containerPath, true)
+	case STORAGE_ZIP:
+		return OpenZipStorage(containerPath)
+	}
+	return nil, fmt.Errorf("unknown storage %s, expected one of %s, %s, %s or %s", kind, STORAGE_DIR, STORAGE_TAR, STORAGE_TAR_GZ, STORAGE_ZIP)
+}
+
+// validContainerName reports whether a name can be stored inside an archive
+// file, which cannot hold paths outside of the conversation.
+func validContainerName(name string) error {
+	clean := path.Clean(name)
+	if clean != name || path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("%s cannot be stored in an archive file, paths must stay inside the conversation", name)
+	}
+	return nil
+}
+
+// DirStorage keeps every file as a regular file under the conversation
+// directory. Media can be deduplicated through a BlobStore with PutMedia, the
+// events and bookkeeping are always regular files.
+type DirStorage struct {
+	Root  string
+	Blobs *BlobStore
+}
+
+func (storage *DirStorage) Path(name string) string {
+	return filepath.Join(storage.Root, filepath.FromSlash(name))
+}
+
+func (storage *DirStorage) Put(name string, data []byte) error {
+	target := storage.Path(name)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmpPath := target + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	err = os.Rename(tmpPath, target)
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", target, err)
+	}
+	// Older versions also deduplicated the events, the regular file supersedes
+	// the pointer.
+	err = os.Remove(target + BLOB_POINTER_EXT)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove blob pointer of %s: %w", target, err)
+	}
+	return nil
+}
+
+// PutMedia stores a media file through the blob store when deduplicating, and
+// as a regular file otherwise. Only media are deduplicated, since the blobs are
+// collected once no manifest record references them.
+func (storage *DirStorage) PutMedia(name string, data []byte) error {
+	if storage.Blobs == nil {
+		return storage.Put(name, data)
+	}
+	sum, err := storage.Blobs.Put(data)
+	if err != nil {
+		return err
+	}
+	return storage.Blobs.Link(sum, storage.Path(name))
+}
+
+func (storage *DirStorage) Get(name string) ([]byte, error) {
+	var data []byte
+	var err error
+	if storage.Blobs != nil {
+		data, err = storage.Blobs.Read(storage.Path(name))
+	} else {
+		data, err = os.ReadFile(storage.Path(name))
+	}
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotStored)
+	}
+	return data, err
+}
+
+func (storage *DirStorage) Exists(name string) bool {
+	return fileOrPointerExists(storage.Path(name))
+}
+
+func (storage *DirStorage) List(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.WalkDir(storage.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) == ".tmp" {
+			return nil
+		}
+		relative, err := filepath.Rel(storage.Root, path)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.ToSlash(relative), BLOB_POINTER_EXT)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", storage.Root, err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (storage *DirStorage) Delete(name string) error {
+	target := storage.Path(name)
+	err := os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(target + BLOB_POINTER_EXT)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (storage *DirStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,506 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tarBlockSize   = 512
+	tarTrailerSize = 2 * tarBlockSize
+)
+
+type tarEntry struct {
+	// Offset of the tar header of the entry, or of the gzip member holding it.
+	offset int64
+	// skip is how many entries come before it in its gzip member, which is
+	// only set while a .tar.gz file written by another tool is converted.
+	skip int
+	size int64
+}
+
+// TarStorage appends entries to a tar archive, optionally gzip compressed. A
+// file stored twice keeps both copies and the last one wins, like when the
+// archive is extracted.
+//
+// Compressed archives hold every entry in its own gzip member, so an entry can
+// be read without decompressing the ones before it. Since concatenated gzip
+// members decompress to a single stream, the file stays a regular .tar.gz.
+type TarStorage struct {
+	Path    string
+	gzip    bool
+	mutex   sync.Mutex
+	file    *os.File
+	end     int64
+	entries map[string]tarEntry
+}
+
+func OpenTarStorage(path string, compressed bool) (*TarStorage, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+	storage := TarStorage{
+		Path:    path,
+		gzip:    compressed,
+		file:    file,
+		entries: make(map[string]tarEntry),
+	}
+
+	if compressed {
+		var single bool
+		single, err = storage.scanGzip()
+		if err == nil && single {
+			err = storage.splitGzip()
+		}
+	} else {
+		err = storage.scanTar()
+	}
+	if err != nil {
+		storage.file.Close()
+		return nil, err
+	}
+
+	// Drop the trailer, or whatever is left of an entry that was being written
+	// when a previous run stopped, and continue right after the last entry.
+	err = storage.file.Truncate(storage.end)
+	if err != nil {
+		storage.file.Close()
+		return nil, fmt.Errorf("failed to truncate archive %s: %w", path, err)
+	}
+	return &storage, nil
+}
+
+// scanTar lists the entries up to the end of archive marker, or up to an entry
+// cut short at the end of the file. Anything else that cannot be read leaves
+// the file alone, since it would be lost when appending.
+func (storage *TarStorage) scanTar() error {
+	info, err := storage.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat archive %s: %w", storage.Path, err)
+	}
+	size := info.Size()
+	for storage.end < size {
+		section := io.NewSectionReader(storage.file, storage.end, size-storage.end)
+		reader := tar.NewReader(section)
+		header, err := reader.Next()
+		if err == io.EOF && storage.zeroBlockAt(size) {
+			return storage.checkTrailer(size)
+		}
+		if err == io.EOF {
+			// Extended headers without the header they belong to.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return storage.checkCutShort(err, size)
+		}
+		dataOffset, _ := section.Seek(0, io.SeekCurrent)
+		entryEnd := storage.end + dataOffset + roundUpToBlock(header.Size)
+		if entryEnd > size {
+			// The data of the last entry was being written.
+			return nil
+		}
+		if header.Typeflag == tar.TypeReg {
+			storage.entries[header.Name] = tarEntry{offset: storage.end, size: header.Size}
+		}
+		storage.end = entryEnd
+	}
+	return nil
+}
+
+func (storage *TarStorage) zeroBlockAt(size int64) bool {
+	block := make([]byte, tarBlockSize)
+	n, _ := storage.file.ReadAt(block, storage.end)
+	return n == tarBlockSize && bytes.Count(block, []byte{0}) == tarBlockSize
+}
+
+// checkTrailer makes sure nothing but padding follows the end of archive
+// marker.
+func (storage *TarStorage) checkTrailer(size int64) error {
+	reader := bufio.NewReader(io.NewSectionReader(storage.file, storage.end, size-storage.end))
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive %s: %w", storage.Path, err)
+		}
+		if b != 0 {
+			return fmt.Errorf("archive %s holds data after its end of archive marker at offset %d", storage.Path, storage.end)
+		}
+	}
+}
+
+// checkCutShort accepts a header that cannot be read as the start of an entry
+// that was being written when a run stopped, as long as no entry follows it.
+func (storage *TarStorage) checkCutShort(cause error, size int64) error {
+	if storage.end == 0 {
+		return fmt.Errorf("%s is not a tar archive: %w", storage.Path, cause)
+	}
+	if errors.Is(cause, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	found, err := storage.findTarHeader(storage.end+tarBlockSize, size)
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("archive %s is corrupt at offset %d: %w", storage.Path, storage.end, cause)
+	}
+	return nil
+}
+
+// findTarHeader reports whether a block from offset on is a valid tar header.
+func (storage *TarStorage) findTarHeader(offset int64, size int64) (bool, error) {
+	reader := bufio.NewReader(io.NewSectionReader(storage.file, offset, size-offset))
+	block := make([]byte, tarBlockSize)
+	for {
+		_, err := io.ReadFull(reader, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read archive %s: %w", storage.Path, err)
+		}
+		if isTarHeader(block) {
+			return true, nil
+		}
+	}
+}
+
+// isTarHeader checks the checksum of a header block, which covers the block
+// with the checksum field itself counted as spaces.
+func isTarHeader(block []byte) bool {
+	field := strings.Trim(string(block[148:156]), " \x00")
+	checksum, err := strconv.ParseInt(field, 8, 64)
+	if err != nil {
+		return false
+	}
+	sum := int64(0)
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	return sum == checksum
+}
+
+// scanGzip lists the entries of the gzip members up to a member cut short at
+// the end of the file, which is dropped like for plain tar files. It reports
+// whether a member holds several entries, as in .tar.gz files written by other
+// tools with a single compressed stream.
+func (storage *TarStorage) scanGzip() (bool, error) {
+	info, err := storage.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat archive %s: %w", storage.Path, err)
+	}
+	size := info.Size()
+	counter := &countingReader{reader: io.NewSectionReader(storage.file, 0, size)}
+	buffered := bufio.NewReader(counter)
+	single := false
+	for {
+		offset := counter.count - int64(buffered.Buffered())
+		if _, err := buffered.Peek(1); err != nil {
+			return single, nil
+		}
+		entries, trailer, err := readGzipMember(buffered)
+		if err != nil {
+			return false, storage.checkGzipCutShort(err, offset, size)
+		}
+		end := counter.count - int64(buffered.Buffered())
+		if len(entries) == 0 && trailer && end < size {
+			return false, fmt.Errorf("archive %s holds data after its end of archive marker at offset %d", storage.Path, end)
+		}
+		if len(entries) > 1 || (len(entries) > 0 && trailer) {
+			single = true
+		}
+		for skip, header := range entries {
+			if header.Typeflag == tar.TypeReg {
+				storage.entries[header.Name] = tarEntry{offset: offset, skip: skip, size: header.Size}
+			}
+		}
+		if len(entries) > 0 {
+			storage.end = end
+		}
+	}
+}
+
+// readGzipMember reads a whole gzip member and returns the headers of its
+// entries, and whether it ends with the end of archive marker.
+func readGzipMember(reader *bufio.Reader) ([]*tar.Header, bool, error) {
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, false, err
+	}
+	gzipReader.Multistream(false)
+	counter := &countingReader{reader: gzipReader}
+	tarReader := tar.NewReader(counter)
+	headers := make([]*tar.Header, 0, 1)
+	entriesEnd := int64(0)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			// Either the member ends, or zero blocks were read past the last
+			// entry, which is the end of archive marker.
+			trailer := counter.count > entriesEnd
+			_, err = io.Copy(io.Discard, gzipReader)
+			return headers, trailer, err
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		headers = append(headers, header)
+		entriesEnd = counter.count + roundUpToBlock(header.Size)
+	}
+}
+
+// checkGzipCutShort accepts a gzip member that cannot be read as an entry that
+// was being written when a run stopped, as long as no member follows it.
+func (storage *TarStorage) checkGzipCutShort(cause error, offset int64, size int64) error {
+	if offset == 0 && !errors.Is(cause, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%s is not a tar.gz archive: %w", storage.Path, cause)
+	}
+	if errors.Is(cause, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	found, err := storage.findGzipMember(offset+1, size)
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("archive %s is corrupt at offset %d: %w", storage.Path, offset, cause)
+	}
+	return nil
+}
+
+// findGzipMember reports whether a gzip member holding a tar header starts
+// somewhere from offset on.
+func (storage *TarStorage) findGzipMember(offset int64, size int64) (bool, error) {
+	data := make([]byte, size-offset)
+	_, err := storage.file.ReadAt(data, offset)
+	if err != nil {
+		return false, fmt.Errorf("failed to read archive %s: %w", storage.Path, err)
+	}
+	magic := []byte{0x1f, 0x8b, 0x08}
+	for start := bytes.Index(data, magic); start >= 0; {
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data[start:]))
+		if err == nil {
+			gzipReader.Multistream(false)
+			if _, err := tar.NewReader(gzipReader).Next(); err == nil {
+				return true, nil
+			}
+		}
+		next := bytes.Index(data[start+1:], magic)
+		if next < 0 {
+			break
+		}
+		start += 1 + next
+	}
+	return false, nil
+}
+
+// splitGzip rewrites a .tar.gz file holding several entries per gzip member,
+// as written by other tools, with a member per entry, so it can be read entry
+// by entry and appended to. The copy replaces the file once it is complete.
+func (storage *TarStorage) splitGzip() error {
+	logger.EventsLogger.Printf("Rewriting %s with every entry compressed separately, so it can be appended to\n", storage.Path)
+	names := make([]string, 0, len(storage.entries))
+	for name := range storage.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		first, second := storage.entries[names[i]], storage.entries[names[j]]
+		if first.offset != second.offset {
+			return first.offset < second.offset
+		}
+		return first.skip < second.skip
+	})
+
+	tmpPath := storage.Path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	split := TarStorage{Path: tmpPath, gzip: true, file: tmpFile, entries: make(map[string]tarEntry)}
+	for _, name := range names {
+		var data []byte
+		data, err = storage.Get(name)
+		if err == nil {
+			err = split.Put(name, data)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, storage.Path)
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rewrite archive %s: %w", storage.Path, err)
+	}
+	storage.file.Close()
+	storage.file = tmpFile
+	storage.end = split.end
+	storage.entries = split.entries
+	return nil
+}
+
+func roundUpToBlock(size int64) int64 {
+	return (size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.count += int64(n)
+	return n, err
+}
+
+func (storage *TarStorage) Put(name string, data []byte) error {
+	if err := validContainerName(name); err != nil {
+		return err
+	}
+
+	var entry bytes.Buffer
+	var target io.Writer = &entry
+	var gzipWriter *gzip.Writer
+	if storage.gzip {
+		gzipWriter = gzip.NewWriter(&entry)
+		target = gzipWriter
+	}
+	writer := tar.NewWriter(target)
+	err := writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Format:   tar.FormatPAX,
+	})
+	if err == nil {
+		_, err = writer.Write(data)
+	}
+	if err == nil {
+		// Flush pads the entry to a full block without writing a trailer.
+		err = writer.Flush()
+	}
+	if err == nil && gzipWriter != nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	_, err = storage.file.WriteAt(entry.Bytes(), storage.end)
+	if err != nil {
+		return fmt.Errorf("failed to append %s to %s: %w", name, storage.Path, err)
+	}
+	storage.entries[name] = tarEntry{offset: storage.end, size: int64(len(data))}
+	storage.end += int64(entry.Len())
+	return nil
+}
+
+func (storage *TarStorage) Get(name string) ([]byte, error) {
+	storage.mutex.Lock()
+	entry, ok := storage.entries[name]
+	storage.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotStored)
+	}
+
+	var source io.Reader = io.NewSectionReader(storage.file, entry.offset, 1<<62)
+	if storage.gzip {
+		gzipReader, err := gzip.NewReader(bufio.NewReader(source))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from %s: %w", name, storage.Path, err)
+		}
+		gzipReader.Multistream(false)
+		source = gzipReader
+	}
+	reader := tar.NewReader(source)
+	header, err := reader.Next()
+	for skip := 0; err == nil && skip < entry.skip; skip++ {
+		header, err = reader.Next()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from %s: %w", name, storage.Path, err)
+	}
+	if header.Name != name {
+		return nil, fmt.Errorf("archive %s is corrupt, expected %s and found %s", storage.Path, name, header.Name)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from %s: %w", name, storage.Path, err)
+	}
+	return data, nil
+}
+
+func (storage *TarStorage) Exists(name string) bool {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	_, ok := storage.entries[name]
+	return ok
+}
+
+func (storage *TarStorage) List(prefix string) ([]string, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	names := make([]string, 0, len(storage.entries))
+	for name := range storage.entries {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (storage *TarStorage) Delete(name string) error {
+	return fmt.Errorf("cannot delete %s: %w", name, errors.ErrUnsupported)
+}
+
+// Close writes the end of archive marker, which the next open removes again.
+func (storage *TarStorage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	trailer := make([]byte, tarTrailerSize)
+	if storage.gzip {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		gzipWriter.Write(trailer)
+		gzipWriter.Close()
+		trailer = compressed.Bytes()
+	}
+	_, err := storage.file.WriteAt(trailer, storage.end)
+	if err != nil {
+		storage.file.Close()
+		return fmt.Errorf("failed to finish archive %s: %w", storage.Path, err)
+	}
+	return storage.file.Close()
+}
@@ -0,0 +1,409 @@
+package dlmanager
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type storageBackend struct {
+	name string
+	open func(t *testing.T, dir string) Storage
+}
+
+var storageBackends = []storageBackend{
+	{STORAGE_DIR, func(t *testing.T, dir string) Storage {
+		return &DirStorage{Root: filepath.Join(dir, "conversation")}
+	}},
+	{STORAGE_TAR, func(t *testing.T, dir string) Storage {
+		storage, err := OpenTarStorage(filepath.Join(dir, "conversation.tar"), false)
+		if err != nil {
+			t.Fatalf("failed to open storage: %v", err)
+		}
+		return storage
+	}},
+	{STORAGE_TAR_GZ, func(t *testing.T, dir string) Storage {
+		storage, err := OpenTarStorage(filepath.Join(dir, "conversation.tar.gz"), true)
+		if err != nil {
+			t.Fatalf("failed to open storage: %v", err)
+		}
+		return storage
+	}},
+	{STORAGE_ZIP, func(t *testing.T, dir string) Storage {
+		storage, err := OpenZipStorage(filepath.Join(dir, "conversation.zip"))
+		if err != nil {
+			t.Fatalf("failed to open storage: %v", err)
+		}
+		return storage
+	}},
+}
+
+func mustPut(t *testing.T, storage Storage, name string, data string) {
+	t.Helper()
+	if err := storage.Put(name, []byte(data)); err != nil {
+		t.Fatalf("Put(%s) failed: %v", name, err)
+	}
+}
+
+func expectStored(t *testing.T, storage Storage, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		stored, err := storage.Get(name)
+		if err != nil {
+			t.Errorf("Get(%s) failed: %v", name, err)
+			continue
+		}
+		if string(stored) != data {
+			t.Errorf("Get(%s) = %q, want %q", name, stored, data)
+		}
+		if !storage.Exists(name) {
+			t.Errorf("Exists(%s) = false, want true", name)
+		}
+	}
+}
+
+func expectListed(t *testing.T, storage Storage, prefix string, want []string) {
+	t.Helper()
+	names, err := storage.List(prefix)
+	if err != nil {
+		t.Fatalf("List(%s) failed: %v", prefix, err)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("List(%s) = %v, want %v", prefix, names, want)
+	}
+}
+
+func TestStorageRoundTrip(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			dir := t.TempDir()
+			storage := backend.open(t, dir)
+			mustPut(t, storage, "events/1.json", `{"page":1}`)
+			mustPut(t, storage, "photos/1_10.jpg", "first photo")
+			expectStored(t, storage, map[string]string{"events/1.json": `{"page":1}`})
+			if err := storage.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			storage = backend.open(t, dir)
+			mustPut(t, storage, "events/2.json", `{"page":2}`)
+			mustPut(t, storage, "photos/1_10.jpg", "photo stored again")
+			files := map[string]string{
+				"events/1.json":   `{"page":1}`,
+				"events/2.json":   `{"page":2}`,
+				"photos/1_10.jpg": "photo stored again",
+			}
+			expectStored(t, storage, files)
+			expectListed(t, storage, "events/", []string{"events/1.json", "events/2.json"})
+			if _, err := storage.Get("events/3.json"); !errors.Is(err, ErrNotStored) {
+				t.Errorf("Get of a missing entry = %v, want %v", err, ErrNotStored)
+			}
+			if err := storage.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			storage = backend.open(t, dir)
+			defer storage.Close()
+			expectStored(t, storage, files)
+			expectListed(t, storage, "", []string{"events/1.json", "events/2.json", "photos/1_10.jpg"})
+		})
+	}
+}
+
+func TestTarStorageInterruptedWrite(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "conversation.tar")
+		storage, err := OpenTarStorage(path, compressed)
+		if err != nil {
+			t.Fatalf("failed to open storage: %v", err)
+		}
+		mustPut(t, storage, "events/1.json", `{"page":1}`)
+		mustPut(t, storage, "photos/1_10.jpg", "photo")
+		// The run stops while the next entry is being appended, before Close.
+		end := storage.end
+		storage.file.Close()
+		other, err := OpenTarStorage(filepath.Join(t.TempDir(), "other.tar"), compressed)
+		if err != nil {
+			t.Fatalf("failed to open storage: %v", err)
+		}
+		// Random data does not compress, so the first KiB is a partial entry.
+		video := make([]byte, 4096)
+		rand.Read(video)
+		mustPut(t, other, "videos/1_11.mp4", string(video))
+		partial := make([]byte, 1024)
+		other.file.ReadAt(partial, 0)
+		other.Close()
+		file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("failed to open archive: %v", err)
+		}
+		file.WriteAt(partial, end)
+		file.Close()
+
+		storage, err = OpenTarStorage(path, compressed)
+		if err != nil {
+			t.Fatalf("failed to reopen storage: %v", err)
+		}
+		if storage.Exists("videos/1_11.mp4") {
+			t.Errorf("compressed=%v: the incomplete entry was kept", compressed)
+		}
+		mustPut(t, storage, "events/2.json", `{"page":2}`)
+		if err := storage.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		storage, err = OpenTarStorage(path, compressed)
+		if err != nil {
+			t.Fatalf("failed to reopen storage: %v", err)
+		}
+		expectStored(t, storage, map[string]string{
+			"events/1.json":   `{"page":1}`,
+			"photos/1_10.jpg": "photo",
+			"events/2.json":   `{"page":2}`,
+		})
+		expectListed(t, storage, "", []string{"events/1.json", "events/2.json", "photos/1_10.jpg"})
+		storage.Close()
+	}
+}
+
+func TestZipStorageInterruptedRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversation.zip")
+	storage, err := OpenZipStorage(path)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	mustPut(t, storage, "events/1.json", `{"page":1}`)
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	storage, err = OpenZipStorage(path)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	mustPut(t, storage, "events/2.json", `{"page":2}`)
+	mustPut(t, storage, "photos/1_10.jpg", "photo")
+	// The run stops in the middle of the next entry, before Close.
+	storage.writer.CreateRaw(&zip.FileHeader{Name: "videos/1_11.mp4", CompressedSize64: 4096, UncompressedSize64: 4096})
+	storage.writer.Flush()
+	storage.tmpFile.Write([]byte("partial"))
+	storage.tmpFile.Close()
+	storage.closePrevious()
+
+	storage, err = OpenZipStorage(path)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	if storage.Exists("videos/1_11.mp4") {
+		t.Errorf("the incomplete entry was recovered")
+	}
+	files := map[string]string{
+		"events/1.json":   `{"page":1}`,
+		"events/2.json":   `{"page":2}`,
+		"photos/1_10.jpg": "photo",
+	}
+	expectStored(t, storage, files)
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(path + ".recover"); !os.IsNotExist(err) {
+		t.Errorf("the recovered temporary file was left behind")
+	}
+
+	storage, err = OpenZipStorage(path)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	expectStored(t, storage, files)
+	expectListed(t, storage, "", []string{"events/1.json", "events/2.json", "photos/1_10.jpg"})
+}
+
+func TestDirStorageDeduplicatesMediaOnly(t *testing.T) {
+	dir := t.TempDir()
+	storage := DirStorage{Root: filepath.Join(dir, "conversation"), Blobs: NewBlobStore(dir)}
+	mustPut(t, &storage, "events/1.json", `{"page":1}`)
+	if err := storage.PutMedia("photos/1_10.jpg", []byte("photo")); err != nil {
+		t.Fatalf("PutMedia failed: %v", err)
+	}
+
+	blob, err := os.Stat(storage.Blobs.blobPath(sha256Hex([]byte("photo"))))
+	if err != nil {
+		t.Fatalf("the media was not stored in the blob store: %v", err)
+	}
+	media, err := os.Stat(storage.Path("photos/1_10.jpg"))
+	if err != nil || !os.SameFile(blob, media) {
+		t.Errorf("the media does not link to its blob")
+	}
+	if _, err := os.Stat(storage.Blobs.blobPath(sha256Hex([]byte(`{"page":1}`)))); !os.IsNotExist(err) {
+		t.Errorf("the event page was stored in the blob store")
+	}
+	expectStored(t, &storage, map[string]string{"events/1.json": `{"page":1}`, "photos/1_10.jpg": "photo"})
+}
+
+func TestTarStorageRefusesCorruptArchive(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "conversation.tar")
+		storage, err := OpenTarStorage(path, compressed)
+		if err != nil {
+			t.Fatalf("failed to open storage: %v", err)
+		}
+		mustPut(t, storage, "events/1.json", `{"page":1}`)
+		mustPut(t, storage, "events/2.json", `{"page":2}`)
+		mustPut(t, storage, "events/3.json", `{"page":3}`)
+		corrupt := storage.entries["events/2.json"].offset + 20
+		if err := storage.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("failed to open archive: %v", err)
+		}
+		file.WriteAt(bytes.Repeat([]byte("x"), 64), corrupt)
+		file.Close()
+		before, _ := os.ReadFile(path)
+
+		// Valid entries follow the corrupt one, so it was not cut short.
+		if _, err := OpenTarStorage(path, compressed); err == nil || !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("compressed=%v: OpenTarStorage = %v, want a corrupt archive error", compressed, err)
+		}
+		if after, _ := os.ReadFile(path); !bytes.Equal(after, before) {
+			t.Errorf("compressed=%v: the corrupt archive was changed", compressed)
+		}
+	}
+}
+
+func TestTarStorageRefusesForeignFile(t *testing.T) {
+	content := []byte(strings.Repeat("not an archive\n", 100))
+	for _, compressed := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "notes.txt")
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		if _, err := OpenTarStorage(path, compressed); err == nil {
+			t.Errorf("compressed=%v: a text file was opened as an archive", compressed)
+		}
+		if after, _ := os.ReadFile(path); !bytes.Equal(after, content) {
+			t.Errorf("compressed=%v: the file was changed", compressed)
+		}
+	}
+}
+
+func TestTarStorageSingleStreamGzip(t *testing.T) {
+	// A .tar.gz file as written by tar -czf, with one compressed stream.
+	path := filepath.Join(t.TempDir(), "conversation.tar.gz")
+	files := map[string]string{
+		"events/1.json":   `{"page":1}`,
+		"events/2.json":   `{"page":2}`,
+		"photos/1_10.jpg": "photo",
+	}
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, name := range []string{"events/1.json", "events/2.json", "photos/1_10.jpg"} {
+		tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(files[name])), Mode: 0644})
+		tarWriter.Write([]byte(files[name]))
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	if err := os.WriteFile(path, archive.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+
+	storage, err := OpenTarStorage(path, true)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	expectStored(t, storage, files)
+	mustPut(t, storage, "events/3.json", `{"page":3}`)
+	files["events/3.json"] = `{"page":3}`
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	storage, err = OpenTarStorage(path, true)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	expectStored(t, storage, files)
+	expectListed(t, storage, "", []string{"events/1.json", "events/2.json", "events/3.json", "photos/1_10.jpg"})
+	storage.Close()
+
+	// The whole file still extracts as a single archive.
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("failed to read archive: %v", err)
+	}
+	extracted := 0
+	reader := tar.NewReader(gzipReader)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to extract archive: %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		if files[header.Name] != string(data) {
+			t.Errorf("extracted %s = %q, want %q", header.Name, data, files[header.Name])
+		}
+		extracted++
+	}
+	if extracted != len(files) {
+		t.Errorf("extracted %d entries, want %d", extracted, len(files))
+	}
+}
+
+func TestZipStorageKeepsLastCopy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversation.zip")
+	storage, err := OpenZipStorage(path)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	mustPut(t, storage, "events/1.json", `{"page":1}`)
+	mustPut(t, storage, "photos/1_10.jpg", "photo")
+	mustPut(t, storage, "events/1.json", `{"page":1,"again":true}`)
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file was left behind")
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	archive.Close()
+	sort.Strings(names)
+	if want := []string{"events/1.json", "photos/1_10.jpg"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("archive lists %v, want %v", names, want)
+	}
+
+	storage, err = OpenZipStorage(path)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	expectStored(t, storage, map[string]string{"events/1.json": `{"page":1,"again":true}`, "photos/1_10.jpg": "photo"})
+}
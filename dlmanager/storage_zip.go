@@ -0,0 +1,409 @@
+package dlmanager
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	zipLocalHeaderSignature = 0x04034b50
+	zipLocalHeaderSize      = 30
+	zipDataDescriptorFlag   = 0x8
+)
+
+type zipEntry struct {
+	header     zip.FileHeader
+	dataOffset int64
+	compressed int64
+}
+
+// ZipStorage writes a zip archive. Since a zip file ends with its central
+// directory, new entries go to a temporary file that receives the untouched
+// entries of the previous archive on Close and then replaces it. When a run
+// stops before Close, the next open recovers the complete entries of the
+// temporary file, so what was stored is not lost.
+//
+// Every run therefore writes the whole archive again, which costs as much as
+// copying it.
+type ZipStorage struct {
+	Path     string
+	mutex    sync.Mutex
+	previous *zip.ReadCloser
+	old      map[string]*zip.File
+	tmpFile  *os.File
+	writer   *zip.Writer
+	added    map[string]zipEntry
+	// replaced is set when an entry was added twice, so the temporary file
+	// holds a copy that must not end up in the archive.
+	replaced bool
+}
+
+func OpenZipStorage(path string) (*ZipStorage, error) {
+	storage := ZipStorage{
+		Path:  path,
+		old:   make(map[string]*zip.File),
+		added: make(map[string]zipEntry),
+	}
+
+	previous, err := zip.OpenReader(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+	if err == nil {
+		storage.previous = previous
+		for _, file := range previous.File {
+			storage.old[file.Name] = file
+		}
+	}
+
+	// The temporary file of a run that stopped before Close is kept aside until
+	// its entries are recovered into the new one.
+	tmpPath := path + ".tmp"
+	recoverPath := path + ".recover"
+	if _, err := os.Stat(recoverPath); os.IsNotExist(err) {
+		err = os.Rename(tmpPath, recoverPath)
+		if err != nil && !os.IsNotExist(err) {
+			storage.closePrevious()
+			return nil, fmt.Errorf("failed to recover archive %s: %w", path, err)
+		}
+	}
+
+	// What is left of a rewrite that did not finish, see rewrite.
+	os.Remove(path + ".new")
+
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		storage.closePrevious()
+		return nil, fmt.Errorf("failed to create archive %s: %w", path, err)
+	}
+	storage.tmpFile = tmpFile
+	storage.writer = zip.NewWriter(tmpFile)
+
+	err = storage.recoverEntries(recoverPath)
+	if err == nil {
+		err = os.Remove(recoverPath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		storage.closePrevious()
+		tmpFile.Close()
+		return nil, fmt.Errorf("failed to recover archive %s: %w", path, err)
+	}
+	return &storage, nil
+}
+
+func (storage *ZipStorage) closePrevious() {
+	if storage.previous != nil {
+		storage.previous.Close()
+	}
+}
+
+// recoverEntries adds the entries found in the temporary file of an earlier
+// run. Entries are written with their sizes and checksum in the local header,
+// so they can be read back without the central directory. The scan stops at
+// the first entry that is incomplete or does not match its checksum.
+func (storage *ZipStorage) recoverEntries(recoverPath string) error {
+	file, err := os.Open(recoverPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset := int64(0)
+	local := make([]byte, zipLocalHeaderSize)
+	for {
+		if _, err := file.ReadAt(local, offset); err != nil {
+			break
+		}
+		if binary.LittleEndian.Uint32(local) != zipLocalHeaderSignature {
+			// The central directory of an archive that was complete after all.
+			break
+		}
+		flags := binary.LittleEndian.Uint16(local[6:])
+		compressed := binary.LittleEndian.Uint32(local[18:])
+		if flags&zipDataDescriptorFlag != 0 || compressed == 0xFFFFFFFF {
+			break
+		}
+		header := zip.FileHeader{
+			Method:             binary.LittleEndian.Uint16(local[8:]),
+			ModifiedTime:       binary.LittleEndian.Uint16(local[10:]),
+			ModifiedDate:       binary.LittleEndian.Uint16(local[12:]),
+			CRC32:              binary.LittleEndian.Uint32(local[14:]),
+			CompressedSize64:   uint64(compressed),
+			UncompressedSize64: uint64(binary.LittleEndian.Uint32(local[22:])),
+		}
+		nameLength := int64(binary.LittleEndian.Uint16(local[26:]))
+		extraLength := int64(binary.LittleEndian.Uint16(local[28:]))
+		name := make([]byte, nameLength)
+		if _, err := file.ReadAt(name, offset+zipLocalHeaderSize); err != nil {
+			break
+		}
+		header.Name = string(name)
+		dataOffset := offset + zipLocalHeaderSize + nameLength + extraLength
+		payload := make([]byte, compressed)
+		if _, err := file.ReadAt(payload, dataOffset); err != nil {
+			break
+		}
+		if !validZipPayload(&header, payload) || validContainerName(header.Name) != nil {
+			break
+		}
+		err = storage.writeEntry(&header, payload)
+		if err != nil {
+			return err
+		}
+		offset = dataOffset + int64(compressed)
+	}
+	return nil
+}
+
+// validZipPayload checks that a payload decodes to the size and checksum its
+// header announces.
+func validZipPayload(header *zip.FileHeader, payload []byte) bool {
+	data := payload
+	switch header.Method {
+	case zip.Store:
+	case zip.Deflate:
+		decompressed, err := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return false
+		}
+		data = decompressed
+	default:
+		return false
+	}
+	return uint64(len(data)) == header.UncompressedSize64 && crc32.ChecksumIEEE(data) == header.CRC32
+}
+
+// compressionMethod stores media as is, since it is already compressed.
+func compressionMethod(name string) uint16 {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json", ".jsonl", ".txt", ".html":
+		return zip.Deflate
+	}
+	return zip.Store
+}
+
+func (storage *ZipStorage) Put(name string, data []byte) error {
+	if err := validContainerName(name); err != nil {
+		return err
+	}
+
+	method := compressionMethod(name)
+	payload := data
+	if method == zip.Deflate {
+		var compressed bytes.Buffer
+		writer, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+		writer.Write(data)
+		writer.Close()
+		payload = compressed.Bytes()
+	}
+
+	header := zip.FileHeader{
+		Name:               name,
+		Method:             method,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(payload)),
+		UncompressedSize64: uint64(len(data)),
+	}
+	// CreateRaw does not derive the MS-DOS time fields from Modified.
+	header.SetModTime(time.Now())
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.writeEntry(&header, payload)
+}
+
+// writeEntry appends an entry to the temporary file and flushes it, so the
+// entry can be recovered once Put returns.
+func (storage *ZipStorage) writeEntry(header *zip.FileHeader, payload []byte) error {
+	writer, err := storage.writer.CreateRaw(header)
+	if err == nil {
+		err = storage.writer.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add %s to %s: %w", header.Name, storage.Path, err)
+	}
+	dataOffset, err := storage.tmpFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(payload)
+	if err == nil {
+		err = storage.writer.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add %s to %s: %w", header.Name, storage.Path, err)
+	}
+	if _, ok := storage.added[header.Name]; ok {
+		storage.replaced = true
+	}
+	storage.added[header.Name] = zipEntry{header: *header, dataOffset: dataOffset, compressed: int64(len(payload))}
+	return nil
+}
+
+func (storage *ZipStorage) Get(name string) ([]byte, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if entry, ok := storage.added[name]; ok {
+		err := storage.writer.Flush()
+		if err != nil {
+			return nil, err
+		}
+		var reader io.Reader = io.NewSectionReader(storage.tmpFile, entry.dataOffset, entry.compressed)
+		if entry.header.Method == zip.Deflate {
+			reader = flate.NewReader(reader)
+		}
+		return io.ReadAll(reader)
+	}
+
+	file, ok := storage.old[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotStored)
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from %s: %w", name, storage.Path, err)
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func (storage *ZipStorage) Exists(name string) bool {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	_, added := storage.added[name]
+	_, old := storage.old[name]
+	return added || old
+}
+
+func (storage *ZipStorage) List(prefix string) ([]string, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	names := make([]string, 0, len(storage.old)+len(storage.added))
+	for name := range storage.old {
+		if _, added := storage.added[name]; !added && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	for name := range storage.added {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (storage *ZipStorage) Delete(name string) error {
+	return fmt.Errorf("cannot delete %s: %w", name, errors.ErrUnsupported)
+}
+
+// Close copies the entries of the previous archive that were not replaced and
+// atomically swaps the new archive in.
+func (storage *ZipStorage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	defer storage.closePrevious()
+
+	if storage.replaced {
+		return storage.rewrite()
+	}
+	err := storage.copyPrevious(storage.writer)
+	if err == nil {
+		err = storage.writer.Close()
+	}
+	closeErr := storage.tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to finish archive %s: %w", storage.Path, err)
+	}
+	err = os.Rename(storage.tmpFile.Name(), storage.Path)
+	if err != nil {
+		return fmt.Errorf("failed to replace archive %s: %w", storage.Path, err)
+	}
+	return nil
+}
+
+// copyPrevious copies the entries of the previous archive that were not
+// replaced, only the last one of names it holds several times.
+func (storage *ZipStorage) copyPrevious(writer *zip.Writer) error {
+	if storage.previous == nil {
+		return nil
+	}
+	for _, file := range storage.previous.File {
+		if _, added := storage.added[file.Name]; added || storage.old[file.Name] != file {
+			continue
+		}
+		if err := writer.Copy(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite writes the archive into a new file with only the last copy of every
+// entry, since a zip writer lists every entry it was given.
+func (storage *ZipStorage) rewrite() error {
+	err := storage.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to finish archive %s: %w", storage.Path, err)
+	}
+	entries := make([]zipEntry, 0, len(storage.added))
+	for _, entry := range storage.added {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].dataOffset < entries[j].dataOffset
+	})
+
+	newPath := storage.Path + ".new"
+	newFile, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create archive %s: %w", newPath, err)
+	}
+	writer := zip.NewWriter(newFile)
+	for i := 0; err == nil && i < len(entries); i++ {
+		var target io.Writer
+		target, err = writer.CreateRaw(&entries[i].header)
+		if err == nil {
+			_, err = io.Copy(target, io.NewSectionReader(storage.tmpFile, entries[i].dataOffset, entries[i].compressed))
+		}
+	}
+	if err == nil {
+		err = storage.copyPrevious(writer)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	closeErr := newFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(newPath)
+		return fmt.Errorf("failed to finish archive %s: %w", storage.Path, err)
+	}
+	err = os.Rename(newPath, storage.Path)
+	if err != nil {
+		return fmt.Errorf("failed to replace archive %s: %w", storage.Path, err)
+	}
+	// The temporary file is only removed once the archive holds its entries,
+	// so they are recovered if the run stops before.
+	storage.tmpFile.Close()
+	os.Remove(storage.tmpFile.Name())
+	return nil
+}
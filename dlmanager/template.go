@@ -0,0 +1,153 @@
+package dlmanager
+
+import (
+	"XDMArchiver/utils"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_MEDIA_TEMPLATE = "{conversation}/{media_dir}/{filename}"
+)
+
+var templateVariablePattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+var templateVariables = map[string]bool{
+	"conversation":       true,
+	"year":               true,
+	"month":              true,
+	"day":                true,
+	"hour":               true,
+	"minute":             true,
+	"second":             true,
+	"date":               true,
+	"sender_id":          true,
+	"sender_screen_name": true,
+	"message_id":         true,
+	"media_id":           true,
+	"media_type":         true,
+	"media_dir":          true,
+	"bitrate":            true,
+	"ext":                true,
+	"filename":           true,
+}
+
+// MediaTemplate decides where a media file is stored, relative to the output
+// directory, out of {variable} placeholders.
+type MediaTemplate struct {
+	Raw string
+}
+
+func ParseMediaTemplate(raw string) (*MediaTemplate, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, fmt.Errorf("media template is empty")
+	}
+	if filepath.IsAbs(raw) {
+		return nil, fmt.Errorf("media template %s must be relative to the output directory", raw)
+	}
+	for _, match := range templateVariablePattern.FindAllStringSubmatch(raw, -1) {
+		if !templateVariables[match[1]] {
+			return nil, fmt.Errorf("unknown variable {%s} in media template %s", match[1], raw)
+		}
+	}
+	// Variables never add or leave a directory level, so the template itself
+	// must keep every path inside the output directory.
+	sample := templateVariablePattern.ReplaceAllString(raw, "x")
+	for _, segment := range strings.Split(strings.ReplaceAll(sample, "\\", "/"), "/") {
+		if segment == ".." {
+			return nil, fmt.Errorf("media template %s must not contain .. path segments", raw)
+		}
+	}
+	if !filepath.IsLocal(filepath.FromSlash(sample)) {
+		return nil, fmt.Errorf("media template %s must stay inside the output directory", raw)
+	}
+	// A message can hold several media, so the message id alone is not enough.
+	if !strings.Contains(raw, "{filename}") && !strings.Contains(raw, "{media_id}") {
+		return nil, fmt.Errorf("media template %s must contain {filename} or {media_id} to keep file names unique", raw)
+	}
+	return &MediaTemplate{Raw: raw}, nil
+}
+
+// CheckVideoQuality makes sure every variant picked by the video quality gets
+// its own file: with all, the variants of a video only differ by bitrate.
+func (template *MediaTemplate) CheckVideoQuality(quality *VideoQuality) error {
+	if quality.Policy != QUALITY_ALL || strings.Contains(template.Raw, "{filename}") || strings.Contains(template.Raw, "{bitrate}") {
+		return nil
+	}
+	return fmt.Errorf("media template %s must contain {filename} or {bitrate} to keep every variant with %s", template.Raw, QUALITY_ALL)
+}
+
+func mediaDir(mediaType string) string {
+	switch mediaType {
+	case "Photo":
+		return PHOTOS_DIR
+	case "Video":
+		return VIDEOS_DIR
+	case "Gif":
+		return GIFS_DIR
+	case "Shared":
+		return SHARED_DIR
+	case "Voice":
+		return VOICE_DIR
+	}
+	return strings.ToLower(mediaType)
+}
+
+// Render returns the slash separated path of a media unit. Every variable is
+// sanitized so its value can never add or escape a directory level.
+func (template *MediaTemplate) Render(conversationId string, unit MediaUnit, location *time.Location) string {
+	values := map[string]string{
+		"conversation":       conversationId,
+		"sender_id":          unit.SenderId,
+		"sender_screen_name": unit.SenderScreenName,
+		"message_id":         unit.MessageId,
+		"media_id":           unit.MediaId,
+		"media_type":         strings.ToLower(unit.MediaType),
+		"media_dir":          mediaDir(unit.MediaType),
+		"ext":                strings.TrimPrefix(filepath.Ext(unit.Filename), "."),
+		"filename":           unit.Filename,
+	}
+	if unit.Bitrate != 0 {
+		values["bitrate"] = strconv.Itoa(unit.Bitrate)
+	}
+
+	t, err := utils.UnixTimestampStringToTime(unit.MessageTime, true)
+	if err == nil {
+		local := t.In(location)
+		values["year"] = local.Format("2006")
+		values["month"] = local.Format("01")
+		values["day"] = local.Format("02")
+		values["hour"] = local.Format("15")
+		values["minute"] = local.Format("04")
+		values["second"] = local.Format("05")
+		values["date"] = local.Format(time.DateOnly)
+	}
+
+	return templateVariablePattern.ReplaceAllStringFunc(template.Raw, func(match string) string {
+		value := values[match[1:len(match)-1]]
+		if value == "" {
+			return "unknown"
+		}
+		return sanitizePathComponent(value)
+	})
+}
+
+// sanitizePathComponent replaces the characters that are not allowed in file
+// names on Windows, macOS or Linux filesystems.
+func sanitizePathComponent(value string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, value)
+	sanitized = strings.TrimRight(sanitized, ". ")
+	if sanitized == "" || sanitized == ".." {
+		return "_"
+	}
+	return sanitized
+}
@@ -0,0 +1,74 @@
+package dlmanager
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMediaTemplate(t *testing.T) {
+	tests := []struct {
+		raw   string
+		error string
+	}{
+		{DEFAULT_MEDIA_TEMPLATE, ""},
+		{"{conversation}/{year}/{month}/{sender_screen_name}/{message_id}_{media_id}.{ext}", ""},
+		{"{conversation}/{media_dir}/{message_id}_{bitrate}_{filename}", ""},
+		{"", "empty"},
+		{"   ", "empty"},
+		{"/archive/{media_id}", "relative"},
+		{"../../x/{media_id}", ".. path segments"},
+		{"{conversation}/../../{media_id}", ".. path segments"},
+		{`{conversation}\..\{media_id}`, ".. path segments"},
+		{"{conversation}/{unknown}/{media_id}", "unknown variable {unknown}"},
+		{"{conversation}/{message_id}.{ext}", "{filename} or {media_id}"},
+		{"{conversation}/{date}.{ext}", "{filename} or {media_id}"},
+	}
+	for _, test := range tests {
+		_, err := ParseMediaTemplate(test.raw)
+		if test.error == "" {
+			if err != nil {
+				t.Errorf("ParseMediaTemplate(%q) = %v, want no error", test.raw, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("ParseMediaTemplate(%q) = %v, want an error mentioning %q", test.raw, err, test.error)
+		}
+	}
+}
+
+func TestMediaTemplateRender(t *testing.T) {
+	unit := MediaUnit{
+		MediaType:        "Video",
+		MediaId:          "20",
+		MessageId:        "10",
+		MessageTime:      "1700000000000",
+		SenderId:         "5",
+		SenderScreenName: "../evil/name",
+		Bitrate:          832000,
+		Filename:         "10_20_832000.mp4",
+	}
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{DEFAULT_MEDIA_TEMPLATE, "c1/videos/10_20_832000.mp4"},
+		{"{conversation}/{date}/{sender_screen_name}/{media_id}_{bitrate}.{ext}", "c1/2023-11-14/.._evil_name/20_832000.mp4"},
+		{"{conversation}/{hour}{minute}{second}_{media_type}_{media_id}", "c1/221320_video_20"},
+	}
+	for _, test := range tests {
+		template, err := ParseMediaTemplate(test.raw)
+		if err != nil {
+			t.Fatalf("ParseMediaTemplate(%q) failed: %v", test.raw, err)
+		}
+		if rendered := template.Render("c1", unit, time.UTC); rendered != test.want {
+			t.Errorf("Render(%q) = %q, want %q", test.raw, rendered, test.want)
+		}
+	}
+
+	template := &MediaTemplate{Raw: "{conversation}/{sender_id}/{media_id}"}
+	if rendered := template.Render("c1", MediaUnit{MediaId: "20"}, time.UTC); rendered != "c1/unknown/20" {
+		t.Errorf("Render with a missing value = %q, want c1/unknown/20", rendered)
+	}
+}
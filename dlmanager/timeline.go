@@ -0,0 +1,372 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/twitter"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TIMELINE_FILE            = "timeline.jsonl"
+	COMPRESSED_TIMELINE_FILE = "timeline.jsonl.gz"
+)
+
+// TimelineRecord is one line of the compacted timeline. The first line holds
+// the header, followed by the users and then the entries, oldest first.
+type TimelineRecord struct {
+	Header *TimelineHeader `json:"header,omitempty"`
+	User   *twitter.User   `json:"user,omitempty"`
+	Entry  *twitter.Entry  `json:"entry,omitempty"`
+	// Source is the event page the entry was taken from.
+	Source string `json:"source,omitempty"`
+	// Next is the time of the entry that follows in the continuation chain,
+	// which is only known when both were returned in the same page.
+	Next string `json:"next,omitempty"`
+}
+
+type TimelineHeader struct {
+	// Pages are the event pages merged into the timeline.
+	Pages       []string  `json:"pages"`
+	CompactedAt time.Time `json:"compacted_at"`
+}
+
+type Timeline struct {
+	Name   string
+	Header TimelineHeader
+	// Pages has the same names as Header.Pages, for lookups.
+	Pages map[string]bool
+	entryCollector
+}
+
+// entryCollector merges the entries of overlapping event pages, keeping one
+// copy of every message along with the continuation chain between them.
+type entryCollector struct {
+	Entries []twitter.Entry
+	Sources []string
+	ContMap map[string]string
+	Users   map[string]twitter.User
+	// positions maps the key of every collected entry to its index in Entries.
+	positions map[string]int
+}
+
+func newEntryCollector() entryCollector {
+	return entryCollector{
+		Entries:   make([]twitter.Entry, 0),
+		Sources:   make([]string, 0),
+		ContMap:   make(map[string]string),
+		Users:     make(map[string]twitter.User),
+		positions: make(map[string]int),
+	}
+}
+
+func entryKey(entry twitter.Entry) string {
+	if id := entry.GetMessageId(); id != "" {
+		return id
+	}
+	if id := entry.ID(); id != "" {
+		return id
+	}
+	return entry.Type + ":" + entry.Time()
+}
+
+// link records next as the continuation of timestamp, unless a continuation is
+// already known.
+func (collector *entryCollector) link(timestamp string, next string) {
+	if timestamp == next {
+		logger.EventsLogger.Fatalf("Found a loop in the contiuation map with id %s\n", next)
+	}
+	val, isSet := collector.ContMap[timestamp]
+	if (isSet && val == "") || !isSet {
+		collector.ContMap[timestamp] = next
+	}
+}
+
+// add collects a message along with its continuation. Conversation events are
+// collected too but are not part of the continuation chain.
+func (collector *entryCollector) add(source string, entry twitter.Entry, next string) {
+	if !entry.IsSystem() {
+		collector.link(entry.Message.Time, next)
+	}
+	key := entryKey(entry)
+	if position, ok := collector.positions[key]; ok {
+		if isNewerVersion(entry, collector.Entries[position]) {
+			collector.Entries[position] = entry
+			collector.Sources[position] = source
+		}
+		return
+	}
+	collector.positions[key] = len(collector.Entries)
+	collector.Entries = append(collector.Entries, entry)
+	collector.Sources = append(collector.Sources, source)
+}
+
+// isNewerVersion reports whether entry is a later edit of the same message than
+// collected, so the latest text is kept whichever page is read first.
+func isNewerVersion(entry twitter.Entry, collected twitter.Entry) bool {
+	if entry.Message == nil || collected.Message == nil {
+		return false
+	}
+	data, collectedData := entry.Message.MessageData, collected.Message.MessageData
+	if data.Edits() != collectedData.Edits() {
+		return data.Edits() > collectedData.Edits()
+	}
+	editedAt, _ := strconv.ParseInt(string(data.EditedAt), 10, 64)
+	collectedEditedAt, _ := strconv.ParseInt(string(collectedData.EditedAt), 10, 64)
+	return editedAt > collectedEditedAt
+}
+
+// addEvent collects the entries of an event page and returns how many it had.
+func (collector *entryCollector) addEvent(source string, event twitter.ConversationResponse) int {
+	eventEntries := event.GetEntries()
+	count := len(eventEntries)
+	for i := range eventEntries {
+		nextEntryTimestamp := ""
+		if i+1 < len(eventEntries) {
+			nextEntryTimestamp = eventEntries[i+1].Message.Time
+		}
+		collector.add(source, eventEntries[i], nextEntryTimestamp)
+	}
+	for _, entry := range event.GetTimelineEntries() {
+		if entry.IsSystem() {
+			collector.add(source, entry, "")
+			count++
+		}
+	}
+	for id, user := range event.ConversationTimeline.Users {
+		collector.Users[id] = user
+	}
+	return count
+}
+
+func (collector *entryCollector) addTimeline(timeline *Timeline) {
+	for i, entry := range timeline.Entries {
+		next := ""
+		if !entry.IsSystem() {
+			next = timeline.ContMap[entry.Message.Time]
+		}
+		collector.add(timeline.Sources[i], entry, next)
+	}
+	for id, user := range timeline.Users {
+		collector.Users[id] = user
+	}
+}
+
+// sort orders the entries from the oldest to the newest.
+func (collector *entryCollector) sort() {
+	times := make([]int64, len(collector.Entries))
+	for i, entry := range collector.Entries {
+		t, err := strconv.ParseInt(entry.Time(), 10, 64)
+		if err != nil {
+			logger.EventsLogger.Fatalf("Invalid timestamp when sorting the entries %s.", entry.Time())
+		}
+		times[i] = t
+	}
+	sort.Stable(entriesByTime{collector, times})
+}
+
+type entriesByTime struct {
+	collector *entryCollector
+	times     []int64
+}
+
+func (sorter entriesByTime) Len() int { return len(sorter.times) }
+
+func (sorter entriesByTime) Less(i, j int) bool { return sorter.times[i] < sorter.times[j] }
+
+func (sorter entriesByTime) Swap(i, j int) {
+	sorter.times[i], sorter.times[j] = sorter.times[j], sorter.times[i]
+	entries, sources := sorter.collector.Entries, sorter.collector.Sources
+	entries[i], entries[j] = entries[j], entries[i]
+	sources[i], sources[j] = sources[j], sources[i]
+}
+
+// loadTimeline reads the compacted timeline of the conversation, or returns nil
+// when the conversation was never compacted.
+func (dlManager *DLManager) loadTimeline() (*Timeline, error) {
+	name := ""
+	for _, candidate := range []string{COMPRESSED_TIMELINE_FILE, TIMELINE_FILE} {
+		if dlManager.Storage.Exists(candidate) {
+			name = candidate
+			break
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	data, err := dlManager.readEventPage(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timeline %s: %w", name, err)
+	}
+	timeline := Timeline{Name: name, Pages: make(map[string]bool), entryCollector: newEntryCollector()}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record TimelineRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse line %d of timeline %s: %w", line, name, err)
+		}
+		switch {
+		case record.Header != nil:
+			timeline.Header = *record.Header
+			for _, page := range record.Header.Pages {
+				timeline.Pages[page] = true
+			}
+		case record.User != nil:
+			timeline.Users[record.User.IDStr] = *record.User
+		case record.Entry != nil:
+			timeline.add(record.Source, *record.Entry, record.Next)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read timeline %s: %w", name, err)
+	}
+	return &timeline, nil
+}
+
+type CompactReport struct {
+	Pages      int
+	Entries    int
+	Duplicates int
+	Name       string
+}
+
+func (report *CompactReport) Print() {
+	logger.EventsLogger.Printf("Compacted %d event pages into %s: %d entries, %d duplicates dropped\n", report.Pages, report.Name, report.Entries, report.Duplicates)
+}
+
+// Compact merges the event pages, and the previous timeline if any, into one
+// ordered timeline without duplicates. The pages are left in place, later runs
+// read the timeline instead of the pages it covers.
+func (dlManager *DLManager) Compact() (*CompactReport, error) {
+	previous, err := dlManager.loadTimeline()
+	if err != nil {
+		return nil, err
+	}
+	names, err := dlManager.eventPageNames()
+	if err != nil {
+		return nil, err
+	}
+
+	collector := newEntryCollector()
+	merged := make(map[string]bool, len(names))
+	if previous != nil {
+		collector.addTimeline(previous)
+		for _, page := range previous.Header.Pages {
+			merged[page] = true
+		}
+	}
+	// Pages saved again since the previous timeline are merged again, so their
+	// entries replace the older copies.
+	compacted := 0
+	read := 0
+	before := len(collector.Entries)
+	for _, name := range names {
+		if previous.covers(name, dlManager.Index.PageSavedAt(name)) {
+			continue
+		}
+		event, err := dlManager.readEvent(name)
+		if err != nil {
+			return nil, err
+		}
+		read += collector.addEvent(name, *event)
+		merged[name] = true
+		compacted++
+	}
+	collector.sort()
+	pages := make([]string, 0, len(merged))
+	for page := range merged {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	err = encoder.Encode(TimelineRecord{Header: &TimelineHeader{Pages: pages, CompactedAt: time.Now().UTC()}})
+	if err != nil {
+		return nil, err
+	}
+	userIds := make([]string, 0, len(collector.Users))
+	for id := range collector.Users {
+		userIds = append(userIds, id)
+	}
+	sort.Strings(userIds)
+	for _, id := range userIds {
+		user := collector.Users[id]
+		if user.IDStr == "" {
+			user.IDStr = id
+		}
+		if err := encoder.Encode(TimelineRecord{User: &user}); err != nil {
+			return nil, err
+		}
+	}
+	for i := range collector.Entries {
+		entry := collector.Entries[i]
+		record := TimelineRecord{Entry: &entry, Source: collector.Sources[i]}
+		if !entry.IsSystem() {
+			record.Next = collector.ContMap[entry.Message.Time]
+		}
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+
+	name := TIMELINE_FILE
+	if dlManager.Options.CompressEvents {
+		name = COMPRESSED_TIMELINE_FILE
+	}
+	// Only one form of the timeline may exist, or the stale one could win. Archive
+	// files cannot remove the previous one, so its form is kept.
+	if previous != nil && !canDelete(dlManager.Storage) {
+		name = previous.Name
+	}
+	data := buffer.Bytes()
+	if name == COMPRESSED_TIMELINE_FILE {
+		data, err = gzipBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress timeline: %w", err)
+		}
+	}
+	err = dlManager.Storage.Put(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save timeline %s: %w", name, err)
+	}
+	for _, other := range []string{TIMELINE_FILE, COMPRESSED_TIMELINE_FILE} {
+		if other != name && canDelete(dlManager.Storage) && dlManager.Storage.Exists(other) {
+			err = dlManager.Storage.Delete(other)
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove the previous timeline %s: %w", other, err)
+			}
+		}
+	}
+
+	return &CompactReport{
+		Pages:      compacted,
+		Entries:    len(collector.Entries),
+		Duplicates: read - (len(collector.Entries) - before),
+		Name:       name,
+	}, nil
+}
+
+func isTimelineFile(name string) bool {
+	return name == TIMELINE_FILE || name == COMPRESSED_TIMELINE_FILE
+}
+
+// covers reports whether an event page was merged into the timeline, and not
+// saved again since, given when it was saved. Pages saved at an unknown time
+// are taken as merged as they are.
+func (timeline *Timeline) covers(name string, savedAt time.Time) bool {
+	if timeline == nil {
+		return false
+	}
+	merged := timeline.Pages[name] || timeline.Pages[strings.TrimSuffix(name, ".gz")] || timeline.Pages[name+".gz"]
+	return merged && !savedAt.After(timeline.Header.CompactedAt)
+}
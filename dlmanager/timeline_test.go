@@ -0,0 +1,96 @@
+package dlmanager
+
+import (
+	"XDMArchiver/twitter"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T) *DLManager {
+	t.Helper()
+	dir := t.TempDir()
+	conversationPath := filepath.Join(dir, "1-2")
+	return &DLManager{
+		ConversationId:   "1-2",
+		ConversationPath: conversationPath,
+		Storage:          &DirStorage{Root: conversationPath},
+		Index:            openTestIndex(t, filepath.Join(conversationPath, INDEX_FILE)),
+		Options: Options{
+			OutputDir:     dir,
+			MediaTemplate: &MediaTemplate{Raw: DEFAULT_MEDIA_TEMPLATE},
+			VideoQuality:  &VideoQuality{Policy: DEFAULT_VIDEO_QUALITY},
+			Location:      time.UTC,
+		},
+	}
+}
+
+// savePage stores an event page and indexes it as saved at the given time.
+func savePage(t *testing.T, dlManager *DLManager, name string, event twitter.ConversationResponse, savedAt time.Time) {
+	t.Helper()
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to encode page: %v", err)
+	}
+	mustPut(t, dlManager.Storage, name, string(data))
+	if err := dlManager.Index.AddPage(name, event, savedAt); err != nil {
+		t.Fatalf("AddPage(%s) failed: %v", name, err)
+	}
+}
+
+func mustCompact(t *testing.T, dlManager *DLManager) *CompactReport {
+	t.Helper()
+	report, err := dlManager.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	return report
+}
+
+func TestCompactMergesPagesSavedAgain(t *testing.T) {
+	dlManager := newTestManager(t)
+	savedAt := time.Now().UTC().Add(-time.Hour)
+	savePage(t, dlManager, "events/1.json", testPage(testMessage("11", "1001", ""), testMessage("10", "1000", "")), savedAt)
+	savePage(t, dlManager, "events/2.json", testPage(testMessage("10", "1000", ""), testMessage("9", "999", "")), savedAt)
+
+	report := mustCompact(t, dlManager)
+	if report.Pages != 2 || report.Entries != 3 || report.Duplicates != 1 {
+		t.Errorf("first Compact = %+v, want 2 pages, 3 entries and 1 duplicate", *report)
+	}
+
+	// The first page is saved again with an edit and a new message.
+	edited := testMessage("11", "1001", "")
+	edited.Message.MessageData.Text = "edited"
+	edited.Message.MessageData.EditCount = "1"
+	savePage(t, dlManager, "events/1.json", testPage(testMessage("12", "1002", ""), edited), time.Now().UTC())
+
+	if err := dlManager.loadEvents(); err != nil {
+		t.Fatalf("loadEvents failed: %v", err)
+	}
+	if len(dlManager.Events) != 1 {
+		t.Errorf("loadEvents read %d pages next to the timeline, want the page saved again", len(dlManager.Events))
+	}
+
+	report = mustCompact(t, dlManager)
+	if report.Pages != 1 || report.Entries != 4 || report.Duplicates != 1 {
+		t.Errorf("second Compact = %+v, want 1 page, 4 entries and 1 duplicate", *report)
+	}
+	timeline, err := dlManager.loadTimeline()
+	if err != nil {
+		t.Fatalf("loadTimeline failed: %v", err)
+	}
+	if want := []string{"events/1.json", "events/2.json"}; len(timeline.Header.Pages) != len(want) || timeline.Header.Pages[0] != want[0] || timeline.Header.Pages[1] != want[1] {
+		t.Errorf("timeline pages = %v, want %v", timeline.Header.Pages, want)
+	}
+	for _, entry := range timeline.Entries {
+		if entry.GetMessageId() == "11" && entry.Message.MessageData.Text != "edited" {
+			t.Errorf("message 11 = %q, want the edited text", entry.Message.MessageData.Text)
+		}
+	}
+
+	report = mustCompact(t, dlManager)
+	if report.Pages != 0 || report.Duplicates != 0 {
+		t.Errorf("Compact without changes = %+v, want no pages and no duplicates", *report)
+	}
+}
@@ -0,0 +1,176 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/twitter"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	TOMBSTONES_DIR = "tombstones"
+
+	// A message is vanished when a page covering its time no longer has it, and
+	// deleted when the page has a message_delete entry for it.
+	DELETION_VANISHED = "vanished"
+	DELETION_DELETED  = "message_delete"
+)
+
+// Tombstone marks an archived message that was deleted from the conversation
+// afterwards. The message itself stays in the archive: the tombstone keeps its
+// entry, since the page it was archived from can be saved again without it.
+// Tombstones are stored in the storage of the conversation, as
+// tombstones/{message_id}.json.
+type Tombstone struct {
+	MessageId  string    `json:"message_id"`
+	Time       string    `json:"time"`
+	Reason     string    `json:"reason"`
+	DetectedAt time.Time `json:"detected_at"`
+	// LastSeenAt is when the page the message was last archived from was
+	// fetched, unknown for pages fetched by older versions.
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	Page       string     `json:"page"`
+	// Entry is the archived entry, unknown when its page could not be read.
+	Entry *twitter.Entry `json:"entry,omitempty"`
+}
+
+func tombstoneName(messageId string) string {
+	return TOMBSTONES_DIR + "/" + sanitizeFilenamePart(messageId) + ".json"
+}
+
+func (dlManager *DLManager) loadTombstones() (map[string]Tombstone, error) {
+	names, err := dlManager.Storage.List(TOMBSTONES_DIR + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tombstones: %w", err)
+	}
+	tombstones := make(map[string]Tombstone, len(names))
+	for _, name := range names {
+		data, err := dlManager.Storage.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tombstone %s: %w", name, err)
+		}
+		var tombstone Tombstone
+		err = json.Unmarshal(data, &tombstone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to json decode tombstone %s: %w", name, err)
+		}
+		tombstones[tombstone.MessageId] = tombstone
+	}
+	return tombstones, nil
+}
+
+// detectDeletions compares a page about to be saved with the archived
+// messages sent in the time range it covers. The archived messages it does not
+// have anymore, and the ones it has a message_delete entry for, get a
+// tombstone.
+func (dlManager *DLManager) detectDeletions(event twitter.ConversationResponse) error {
+	entries := event.GetEntries()
+	if len(entries) == 0 {
+		return nil
+	}
+	if dlManager.Tombstones == nil {
+		tombstones, err := dlManager.loadTombstones()
+		if err != nil {
+			return err
+		}
+		dlManager.Tombstones = tombstones
+	}
+
+	for _, entry := range event.GetTimelineEntries() {
+		if entry.Type != twitter.ENTRY_MESSAGE_DELETE {
+			continue
+		}
+		for _, deleted := range entry.MessageDelete.Messages {
+			record, ok := dlManager.Index.Lookup(deleted.MessageID)
+			if !ok {
+				continue
+			}
+			err := dlManager.addTombstone(record, DELETION_DELETED)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Entries are sorted from the newest to the oldest.
+	newest, err := strconv.ParseInt(entries[0].Message.Time, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid entry time %s: %w", entries[0].Message.Time, err)
+	}
+	oldest, err := strconv.ParseInt(entries[len(entries)-1].Message.Time, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid entry time %s: %w", entries[len(entries)-1].Message.Time, err)
+	}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[entryKey(entry)] = true
+	}
+	// Messages sent in the same millisecond as the first or the last entry can
+	// be on the neighbouring page, so only the messages sent strictly between
+	// them are compared.
+	records := dlManager.Index.InRange(oldest+1, newest-1)
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time < records[j].Time
+	})
+	for _, record := range records {
+		if present[record.MessageId] {
+			continue
+		}
+		err := dlManager.addTombstone(record, DELETION_VANISHED)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dlManager *DLManager) addTombstone(record IndexRecord, reason string) error {
+	if _, ok := dlManager.Tombstones[record.MessageId]; ok {
+		return nil
+	}
+	tombstone := Tombstone{
+		MessageId:  record.MessageId,
+		Time:       record.Time,
+		Reason:     reason,
+		DetectedAt: time.Now().UTC(),
+		Page:       record.Page,
+	}
+	if lastSeenAt := dlManager.Index.PageSavedAt(record.Page); !lastSeenAt.IsZero() {
+		tombstone.LastSeenAt = &lastSeenAt
+	}
+	// The page is read before it is replaced by the one being saved.
+	entry, err := dlManager.ReadIndexedEntry(record)
+	if err != nil {
+		logger.EventsLogger.Printf("	Could not keep the deleted message %s: %s\n", record.MessageId, err)
+	} else {
+		tombstone.Entry = entry
+	}
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return fmt.Errorf("failed to encode tombstone: %w", err)
+	}
+	name := tombstoneName(record.MessageId)
+	err = dlManager.Storage.Put(name, data)
+	if err != nil {
+		return fmt.Errorf("failed to save tombstone %s: %w", name, err)
+	}
+	dlManager.Tombstones[record.MessageId] = tombstone
+	dlManager.Deletions = append(dlManager.Deletions, tombstone)
+	logger.EventsLogger.Printf("\tMessage %s was deleted since it was archived (%s)\n", record.MessageId, reason)
+	return nil
+}
+
+// printDeletions lists the deleted messages detected during the run.
+func (dlManager *DLManager) printDeletions() {
+	logger.EventsLogger.Printf("Deleted messages detected in this run: %d\n", len(dlManager.Deletions))
+	for _, tombstone := range dlManager.Deletions {
+		lastSeen := "unknown"
+		if tombstone.LastSeenAt != nil {
+			lastSeen = tombstone.LastSeenAt.In(dlManager.Options.Location).Format(time.DateTime)
+		}
+		logger.EventsLogger.Printf("\t%s sent at %s, last seen at %s (%s)\n", tombstone.MessageId, dlManager.formatEntryTime(tombstone.Time), lastSeen, tombstone.Reason)
+	}
+}
@@ -0,0 +1,93 @@
+package dlmanager
+
+import (
+	"XDMArchiver/twitter"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDetectDeletions(t *testing.T) {
+	tests := []struct {
+		name     string
+		archived []twitter.Entry
+		page     []twitter.Entry
+		want     []string
+	}{
+		{
+			"vanished",
+			[]twitter.Entry{testMessage("12", "1002", ""), testMessage("11", "1001", ""), testMessage("10", "1000", "")},
+			[]twitter.Entry{testMessage("12", "1002", ""), testMessage("10", "1000", "")},
+			[]string{"11"},
+		},
+		{
+			"sent in the same millisecond as the first or the last entry",
+			[]twitter.Entry{testMessage("13", "1002", ""), testMessage("12", "1002", ""), testMessage("11", "1001", ""), testMessage("10", "1000", ""), testMessage("9", "1000", "")},
+			[]twitter.Entry{testMessage("12", "1002", ""), testMessage("11", "1001", ""), testMessage("10", "1000", "")},
+			[]string{},
+		},
+		{
+			"deleted",
+			[]twitter.Entry{testMessage("11", "1001", ""), testMessage("10", "1000", "")},
+			[]twitter.Entry{
+				{Type: twitter.ENTRY_MESSAGE_DELETE, MessageDelete: &twitter.MessageDelete{
+					EntryHeader: twitter.EntryHeader{ID: "12", Time: "1002"},
+					Messages:    []twitter.DeletedMessage{{MessageID: "10"}},
+				}},
+				testMessage("11", "1001", ""), testMessage("10", "1000", ""),
+			},
+			[]string{"10"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dlManager := newTestManager(t)
+			savePage(t, dlManager, "events/1.json", testPage(test.archived...), time.Now().UTC().Add(-time.Hour))
+
+			page := testPage(test.page...)
+			if err := dlManager.detectDeletions(page); err != nil {
+				t.Fatalf("detectDeletions failed: %v", err)
+			}
+			deleted := make([]string, 0)
+			for _, tombstone := range dlManager.Deletions {
+				deleted = append(deleted, tombstone.MessageId)
+			}
+			sort.Strings(deleted)
+			if !reflect.DeepEqual(deleted, test.want) {
+				t.Errorf("tombstones = %v, want %v", deleted, test.want)
+			}
+		})
+	}
+}
+
+func TestTombstoneKeepsDeletedMessage(t *testing.T) {
+	dlManager := newTestManager(t)
+	savePage(t, dlManager, "events/1.json", testPage(testMessage("12", "1002", ""), testMessage("11", "1001", ""), testMessage("10", "1000", "")), time.Now().UTC().Add(-time.Hour))
+
+	// The page is saved again without message 11.
+	page := testPage(testMessage("12", "1002", ""), testMessage("10", "1000", ""))
+	if err := dlManager.detectDeletions(page); err != nil {
+		t.Fatalf("detectDeletions failed: %v", err)
+	}
+	savePage(t, dlManager, "events/1.json", page, time.Now().UTC())
+
+	dlManager.Tombstones = nil
+	if err := dlManager.LoadEntries(); err != nil {
+		t.Fatalf("LoadEntries failed: %v", err)
+	}
+	tombstone, ok := dlManager.Tombstones["11"]
+	if !ok || tombstone.Entry == nil {
+		t.Fatalf("tombstone of message 11 = %+v, want one holding the entry", tombstone)
+	}
+	ids := make([]string, 0, len(dlManager.Entries))
+	for _, entry := range dlManager.Entries {
+		ids = append(ids, entryKey(entry))
+		if entryKey(entry) == "11" && entry.Message.MessageData.Text != "message 11" {
+			t.Errorf("message 11 = %q, want the archived text", entry.Message.MessageData.Text)
+		}
+	}
+	if want := []string{"10", "11", "12"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("loaded entries = %v, want %v", ids, want)
+	}
+}
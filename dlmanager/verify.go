@@ -0,0 +1,189 @@
+package dlmanager
+
+import (
+	"XDMArchiver/logger"
+	"XDMArchiver/validator"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type BrokenMedia struct {
+	Unit   MediaUnit
+	Reason string
+}
+
+// VerifyReport lists the problems found in an existing archive.
+type VerifyReport struct {
+	EventFiles      int
+	MediaChecked    int
+	MalformedEvents map[string]error
+	MissingMedia    []MediaUnit
+	BrokenMedia     []BrokenMedia
+	OrphanMedia     []string
+}
+
+func (report *VerifyReport) Problems() int {
+	return len(report.MalformedEvents) + len(report.MissingMedia) + len(report.BrokenMedia) + len(report.OrphanMedia)
+}
+
+func (report *VerifyReport) Print() {
+	logger.EventsLogger.Printf("Checked %d event files and %d media files\n", report.EventFiles, report.MediaChecked)
+	for name, err := range report.MalformedEvents {
+		logger.EventsLogger.Printf("\tMalformed event file %s: %v\n", name, err)
+	}
+	for _, unit := range report.MissingMedia {
+		logger.MediaLogger.Printf("\tMissing %s %s of message %s\n", unit.MediaType, unit.Filename, unit.MessageId)
+	}
+	for _, broken := range report.BrokenMedia {
+		logger.MediaLogger.Printf("\tBroken %s %s: %s\n", broken.Unit.MediaType, broken.Unit.Filename, broken.Reason)
+	}
+	for _, path := range report.OrphanMedia {
+		logger.MediaLogger.Printf("\tOrphan media file %s\n", path)
+	}
+	logger.EventsLogger.Printf("Found %d problems\n", report.Problems())
+}
+
+// Verify checks the archived events and media of the conversation without
+// changing anything on disk. Only the media types enabled in the options are
+// expected to be present.
+func (dlManager *DLManager) Verify() (*VerifyReport, error) {
+	report := VerifyReport{
+		MalformedEvents: make(map[string]error),
+		MissingMedia:    make([]MediaUnit, 0),
+		BrokenMedia:     make([]BrokenMedia, 0),
+		OrphanMedia:     make([]string, 0),
+	}
+
+	names, err := dlManager.eventPageNames()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	verified := make(map[string]bool)
+	for _, name := range names {
+		report.EventFiles++
+		event, err := dlManager.readEvent(name)
+		if err != nil {
+			report.MalformedEvents[name] = err
+			continue
+		}
+		for _, entry := range event.GetEntries() {
+			// Every variant of a video is referenced, only the ones picked by
+			// the video quality are expected.
+			units := mediaUnitsFromEntry(entry, event.ConversationTimeline.Users)
+			for _, unit := range units {
+				referenced[dlManager.mediaName(unit)] = true
+			}
+			for _, unit := range dlManager.selectMedia(units) {
+				name := dlManager.mediaName(unit)
+				if verified[name] || !dlManager.isMediaTypeEnabled(unit.MediaType) {
+					continue
+				}
+				verified[name] = true
+				dlManager.verifyMediaUnit(unit, &report)
+			}
+		}
+	}
+
+	// Only the storage of the conversation is searched for orphans, media stored
+	// outside of the conversation directory by the media template is not.
+	stored, err := dlManager.Storage.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list media: %w", err)
+	}
+	for _, name := range stored {
+		if isArchivedRecord(name) || referenced[name] || isBookkeepingFile(name) {
+			continue
+		}
+		report.OrphanMedia = append(report.OrphanMedia, name)
+	}
+
+	return &report, nil
+}
+
+// isArchivedRecord reports whether a stored file is part of the archived
+// conversation rather than media.
+func isArchivedRecord(name string) bool {
+	for _, dir := range []string{EVENTS_DIR, EDITS_DIR, TOMBSTONES_DIR} {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isBookkeepingFile reports whether a stored file is kept by the archiver
+// itself rather than being media.
+func isBookkeepingFile(name string) bool {
+	switch name {
+	case LOCK_FILE, FAILURES_FILE, MANIFEST_FILE, KEY_FILE, INDEX_FILE:
+		return true
+	}
+	return isTimelineFile(name) || isExportFile(name) || strings.HasPrefix(name, JOURNAL_DIR+"/")
+}
+
+func (dlManager *DLManager) verifyMediaUnit(unit MediaUnit, report *VerifyReport) {
+	name := dlManager.mediaName(unit)
+	if !dlManager.Storage.Exists(name) {
+		report.MissingMedia = append(report.MissingMedia, unit)
+		return
+	}
+	report.MediaChecked++
+	data, err := dlManager.Storage.Get(name)
+	if err != nil {
+		report.BrokenMedia = append(report.BrokenMedia, BrokenMedia{Unit: unit, Reason: err.Error()})
+		return
+	}
+	if len(data) == 0 {
+		report.BrokenMedia = append(report.BrokenMedia, BrokenMedia{Unit: unit, Reason: "zero-byte file"})
+		return
+	}
+	err = validator.Validate(unit.Filename, data)
+	if err != nil {
+		report.BrokenMedia = append(report.BrokenMedia, BrokenMedia{Unit: unit, Reason: err.Error()})
+		return
+	}
+	record, ok := dlManager.Manifest.Get(name)
+	if !ok {
+		return
+	}
+	if record.Size != int64(len(data)) {
+		report.BrokenMedia = append(report.BrokenMedia, BrokenMedia{
+			Unit:   unit,
+			Reason: fmt.Sprintf("size %d differs from %d recorded in the manifest", len(data), record.Size),
+		})
+	} else if record.SHA256 != sha256Hex(data) {
+		report.BrokenMedia = append(report.BrokenMedia, BrokenMedia{Unit: unit, Reason: "sha256 differs from the one recorded in the manifest"})
+	}
+}
+
+// FixVerifyProblems removes the broken media of a report and downloads it again
+// together with the missing media. It returns how many items still failed.
+func (dlManager *DLManager) FixVerifyProblems(report *VerifyReport) int {
+	units := make([]MediaUnit, 0, len(report.MissingMedia)+len(report.BrokenMedia))
+	units = append(units, report.MissingMedia...)
+	for _, broken := range report.BrokenMedia {
+		// Archive files cannot delete entries, the new download supersedes the
+		// broken one instead.
+		err := dlManager.Storage.Delete(dlManager.mediaName(broken.Unit))
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			logger.MediaLogger.Printf("Failed to remove broken file %s: %v\n", broken.Unit.Filename, err)
+			continue
+		}
+		units = append(units, broken.Unit)
+	}
+
+	logger.MediaLogger.Printf("Re-downloading %d media files\n", len(units))
+	dlManager.downloadUnits(units)
+
+	failed := 0
+	for _, unit := range units {
+		if !dlManager.Failures.Has(unit) {
+			continue
+		}
+		failed++
+	}
+	return failed
+}
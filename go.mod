@@ -1,3 +1,7 @@
 module XDMArchiver
 
 go 1.23.0
+
+require golang.org/x/term v0.34.0
+
+require golang.org/x/sys v0.35.0 // indirect
@@ -0,0 +1,24 @@
+package hls
+
+import (
+	"bytes"
+)
+
+// Join puts the segments of a stream back into a single file. MPEG-TS segments
+// are a continuous transport stream cut at packet boundaries, and fMP4
+// segments are movie fragments that follow the initialization segment, so in
+// both cases the file is the segments one after the other. init is nil for
+// MPEG-TS streams.
+func Join(init []byte, segments [][]byte) []byte {
+	size := len(init)
+	for _, segment := range segments {
+		size += len(segment)
+	}
+	var buffer bytes.Buffer
+	buffer.Grow(size)
+	buffer.Write(init)
+	for _, segment := range segments {
+		buffer.Write(segment)
+	}
+	return buffer.Bytes()
+}
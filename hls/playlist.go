@@ -0,0 +1,215 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONTENT_TYPE = "application/x-mpegURL"
+
+	CONTAINER_TS   = "ts"
+	CONTAINER_FMP4 = "fmp4"
+)
+
+// Variant is a stream listed by a master playlist. Audio is the group of the
+// audio renditions it can be played with.
+type Variant struct {
+	URL        string
+	Bandwidth  int
+	Resolution string
+	Codecs     string
+	Audio      string
+}
+
+// Rendition is an alternative stream listed by EXT-X-MEDIA. A rendition
+// without URL is carried inside the variant streams.
+type Rendition struct {
+	Type    string
+	GroupID string
+	Name    string
+	URL     string
+	Default bool
+}
+
+// Segment is a part of the media listed by a media playlist.
+type Segment struct {
+	URL      string
+	Duration float64
+}
+
+// Playlist is a master playlist, which only has variants, or a media playlist,
+// which has the segments of a single stream.
+type Playlist struct {
+	Variants   []Variant
+	Renditions []Rendition
+	Segments   []Segment
+	// InitURL is the initialization segment given by EXT-X-MAP, which fMP4
+	// streams start with.
+	InitURL string
+}
+
+func (playlist *Playlist) IsMaster() bool {
+	return len(playlist.Variants) > 0
+}
+
+// SeparateAudio tells whether the audio of a variant is a rendition of its own,
+// which CMAF streams use, rather than being muxed into the variant stream.
+func (playlist *Playlist) SeparateAudio(variant Variant) bool {
+	if variant.Audio == "" {
+		return false
+	}
+	for _, rendition := range playlist.Renditions {
+		if rendition.Type == "AUDIO" && rendition.GroupID == variant.Audio && rendition.URL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Container returns whether the segments are MPEG-TS or fragmented MP4, which
+// HLS requires to have an initialization segment.
+func (playlist *Playlist) Container() string {
+	if playlist.InitURL != "" {
+		return CONTAINER_FMP4
+	}
+	return CONTAINER_TS
+}
+
+// Parse reads an m3u8 playlist. The URLs it holds are resolved against the URL
+// the playlist was fetched from.
+func Parse(data []byte, playlistUrl string) (*Playlist, error) {
+	base, err := url.Parse(playlistUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid playlist url %s: %w", playlistUrl, err)
+	}
+	resolve := func(reference string) (string, error) {
+		parsed, err := url.Parse(reference)
+		if err != nil {
+			return "", fmt.Errorf("invalid url %s in playlist: %w", reference, err)
+		}
+		return base.ResolveReference(parsed).String(), nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	if !scanner.Scan() || strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff")) != "#EXTM3U" {
+		return nil, errors.New("not an m3u8 playlist, #EXTM3U is missing")
+	}
+
+	playlist := Playlist{
+		Variants:   make([]Variant, 0),
+		Renditions: make([]Rendition, 0),
+		Segments:   make([]Segment, 0),
+	}
+	// Tags that describe the URI on the next line.
+	var variant *Variant
+	var duration *float64
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attributes := parseAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			bandwidth, _ := strconv.Atoi(attributes["BANDWIDTH"])
+			variant = &Variant{Bandwidth: bandwidth, Resolution: attributes["RESOLUTION"], Codecs: attributes["CODECS"], Audio: attributes["AUDIO"]}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attributes := parseAttributes(strings.TrimPrefix(line, "#EXT-X-MEDIA:"))
+			rendition := Rendition{
+				Type:    attributes["TYPE"],
+				GroupID: attributes["GROUP-ID"],
+				Name:    attributes["NAME"],
+				Default: attributes["DEFAULT"] == "YES",
+			}
+			if uri, ok := attributes["URI"]; ok {
+				rendition.URL, err = resolve(uri)
+				if err != nil {
+					return nil, err
+				}
+			}
+			playlist.Renditions = append(playlist.Renditions, rendition)
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid segment duration %s: %w", value, err)
+			}
+			duration = &parsed
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attributes := parseAttributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			if _, ok := attributes["BYTERANGE"]; ok {
+				return nil, errors.New("initialization segments with a byte range are not supported")
+			}
+			playlist.InitURL, err = resolve(attributes["URI"])
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attributes := parseAttributes(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			if method := attributes["METHOD"]; method != "" && method != "NONE" {
+				return nil, fmt.Errorf("encrypted segments (%s) are not supported", method)
+			}
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			return nil, errors.New("segments with a byte range are not supported")
+		case strings.HasPrefix(line, "#"):
+			// Other tags and comments do not change what is downloaded.
+		case variant != nil:
+			variant.URL, err = resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			playlist.Variants = append(playlist.Variants, *variant)
+			variant = nil
+		case duration != nil:
+			segment := Segment{Duration: *duration}
+			segment.URL, err = resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			playlist.Segments = append(playlist.Segments, segment)
+			duration = nil
+		default:
+			return nil, fmt.Errorf("unexpected line %q in playlist", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read playlist: %w", err)
+	}
+	if len(playlist.Variants) == 0 && len(playlist.Segments) == 0 {
+		return nil, errors.New("playlist has neither variants nor segments")
+	}
+	return &playlist, nil
+}
+
+// parseAttributes reads an attribute list such as
+// BANDWIDTH=832000,RESOLUTION=640x360,CODECS="avc1.4d001f,mp4a.40.2", where
+// quoted values may hold commas.
+func parseAttributes(list string) map[string]string {
+	attributes := make(map[string]string)
+	for list != "" {
+		key, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attributes[strings.TrimSpace(key)] = value
+		list = rest
+	}
+	return attributes
+}
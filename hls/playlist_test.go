@@ -0,0 +1,159 @@
+package hls
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const playlistUrl = "https://video.twimg.com/dm_video/1/pl/master.m3u8?tag=1"
+
+func TestParseMasterPlaylist(t *testing.T) {
+	data := `#EXTM3U
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:NAME="Audio",TYPE=AUDIO,GROUP-ID="audio-128000",AUTOSELECT=YES,DEFAULT=YES,URI="/dm_video/1/pl/mp4a/128000/audio.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=256000,RESOLUTION=480x270,CODECS="avc1.4d001e,mp4a.40.2"
+avc1/480x270/video.m3u8
+#EXT-X-STREAM-INF:AVERAGE-BANDWIDTH=2000000,BANDWIDTH=2176000,RESOLUTION=1280x720,CODECS="avc1.640020,mp4a.40.2",AUDIO="audio-128000"
+/dm_video/1/pl/avc1/1280x720/video.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=832000,RESOLUTION=640x360
+https://cdn.example.com/640x360.m3u8
+`
+	playlist, err := Parse([]byte(data), playlistUrl)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !playlist.IsMaster() {
+		t.Fatalf("a playlist with variants is not a master playlist")
+	}
+	want := []Variant{
+		{URL: "https://video.twimg.com/dm_video/1/pl/avc1/480x270/video.m3u8", Bandwidth: 256000, Resolution: "480x270", Codecs: "avc1.4d001e,mp4a.40.2"},
+		{URL: "https://video.twimg.com/dm_video/1/pl/avc1/1280x720/video.m3u8", Bandwidth: 2176000, Resolution: "1280x720", Codecs: "avc1.640020,mp4a.40.2", Audio: "audio-128000"},
+		{URL: "https://cdn.example.com/640x360.m3u8", Bandwidth: 832000, Resolution: "640x360"},
+	}
+	if !reflect.DeepEqual(playlist.Variants, want) {
+		t.Errorf("Variants = %+v, want %+v", playlist.Variants, want)
+	}
+	if len(playlist.Segments) != 0 {
+		t.Errorf("a master playlist has segments: %+v", playlist.Segments)
+	}
+
+	wantRenditions := []Rendition{{
+		Type:    "AUDIO",
+		GroupID: "audio-128000",
+		Name:    "Audio",
+		URL:     "https://video.twimg.com/dm_video/1/pl/mp4a/128000/audio.m3u8",
+		Default: true,
+	}}
+	if !reflect.DeepEqual(playlist.Renditions, wantRenditions) {
+		t.Errorf("Renditions = %+v, want %+v", playlist.Renditions, wantRenditions)
+	}
+	for i, separate := range []bool{false, true, false} {
+		if playlist.SeparateAudio(playlist.Variants[i]) != separate {
+			t.Errorf("SeparateAudio(%s) = %v, want %v", playlist.Variants[i].Resolution, !separate, separate)
+		}
+	}
+}
+
+func TestParseMediaPlaylist(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		initURL   string
+		container string
+	}{
+		{
+			name: "ts",
+			data: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:3.000,
+0.ts
+#EXTINF:1.5,
+/dm_video/1/pl/1.ts
+#EXT-X-ENDLIST
+`,
+			container: CONTAINER_TS,
+		},
+		{
+			name: "fmp4",
+			data: "\ufeff" + `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:3.000,
+0.ts
+#EXTINF:1.5,
+/dm_video/1/pl/1.ts
+#EXT-X-ENDLIST
+`,
+			initURL:   "https://video.twimg.com/dm_video/1/pl/init.mp4",
+			container: CONTAINER_FMP4,
+		},
+	}
+	wantSegments := []Segment{
+		{URL: "https://video.twimg.com/dm_video/1/pl/0.ts", Duration: 3},
+		{URL: "https://video.twimg.com/dm_video/1/pl/1.ts", Duration: 1.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			playlist, err := Parse([]byte(test.data), playlistUrl)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if playlist.IsMaster() {
+				t.Errorf("a playlist with segments is a master playlist")
+			}
+			if !reflect.DeepEqual(playlist.Segments, wantSegments) {
+				t.Errorf("Segments = %+v, want %+v", playlist.Segments, wantSegments)
+			}
+			if playlist.InitURL != test.initURL {
+				t.Errorf("InitURL = %q, want %q", playlist.InitURL, test.initURL)
+			}
+			if playlist.Container() != test.container {
+				t.Errorf("Container() = %q, want %q", playlist.Container(), test.container)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{"not a playlist", "<html></html>", "#EXTM3U is missing"},
+		{"empty playlist", "#EXTM3U\n#EXT-X-ENDLIST\n", "neither variants nor segments"},
+		{"encrypted segments", "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\"\n#EXTINF:3,\n0.ts\n", "encrypted segments (AES-128)"},
+		{"byte range segments", "#EXTM3U\n#EXTINF:3,\n#EXT-X-BYTERANGE:1000@0\nall.ts\n", "byte range"},
+		{"byte range initialization", "#EXTM3U\n#EXT-X-MAP:URI=\"all.mp4\",BYTERANGE=\"800@0\"\n#EXTINF:3,\n0.m4s\n", "byte range"},
+		{"invalid duration", "#EXTM3U\n#EXTINF:abc,\n0.ts\n", "invalid segment duration"},
+		{"uri without tag", "#EXTM3U\n0.ts\n", "unexpected line"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.data), playlistUrl)
+			if err == nil {
+				t.Fatalf("Parse accepted the playlist")
+			}
+			if !strings.Contains(err.Error(), test.error) {
+				t.Errorf("Parse error = %q, want it to mention %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	attributes := parseAttributes(`BANDWIDTH=832000,CODECS="avc1.4d001f,mp4a.40.2",RESOLUTION=640x360,NAME="a=b"`)
+	want := map[string]string{
+		"BANDWIDTH":  "832000",
+		"CODECS":     "avc1.4d001f,mp4a.40.2",
+		"RESOLUTION": "640x360",
+		"NAME":       "a=b",
+	}
+	if !reflect.DeepEqual(attributes, want) {
+		t.Errorf("parseAttributes = %v, want %v", attributes, want)
+	}
+}
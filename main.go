@@ -4,19 +4,52 @@ import (
 	"XDMArchiver/dlmanager"
 	"XDMArchiver/logger"
 	"XDMArchiver/twitter"
+	"XDMArchiver/utils"
+	"bufio"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
 )
 
 const (
 	version = "v1.1.0"
 )
 
+const (
+	CMD_ARCHIVE      = "archive"
+	CMD_RETRY_FAILED = "retry-failed"
+	CMD_VERIFY       = "verify"
+	CMD_MIGRATE      = "migrate-layout"
+	CMD_GC           = "gc"
+	CMD_STATS        = "stats"
+	CMD_COMPRESS     = "compress"
+	CMD_COMPACT      = "compact"
+	CMD_EXPORT       = "export"
+)
+
+const (
+	PASSPHRASE_ENV = "XDM_PASSPHRASE"
+)
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s (version %s):\n", os.Args[0], version)
-		fmt.Printf("\t%s --conversation-id [--auth-headers FILE] [--download-videos] [--download-photos] [--debug]\n", os.Args[0])
+		fmt.Printf("\t%s [command] --conversation-id [--auth-headers FILE] [--download-videos] [--download-photos] [--download-gifs] [--download-shared-media] [--download-voice] [--video-quality QUALITY] [--output DIR] [--media-template TEMPLATE] [--timezone TZ] [--debug]\n", os.Args[0])
+		fmt.Printf("Commands:\n")
+		fmt.Printf("\t%s\tArchive the conversation events and media (default)\n", CMD_ARCHIVE)
+		fmt.Printf("\t%s\tRe-attempt the downloads recorded in the failures ledger\n", CMD_RETRY_FAILED)
+		fmt.Printf("\t%s\t\tCheck the archived events and media for problems\n", CMD_VERIFY)
+		fmt.Printf("\t%s\tRename media saved under the old timestamp based file names\n", CMD_MIGRATE)
+		fmt.Printf("\t%s\t\tRemove deduplicated media no conversation references anymore\n", CMD_GC)
+		fmt.Printf("\t%s\t\tReport the space saved by media deduplication, and the entries of --conversation-id\n", CMD_STATS)
+		fmt.Printf("\t%s\tGzip the event pages saved uncompressed\n", CMD_COMPRESS)
+		fmt.Printf("\t%s\t\tMerge the event pages into one timeline without duplicates\n", CMD_COMPACT)
+		fmt.Printf("\t%s\t\tWrite the archived conversation as a readable text or HTML file\n", CMD_EXPORT)
+		fmt.Printf("Flags:\n")
 		flag.PrintDefaults()
 	}
 	showVersion := flag.Bool("version", false, "Display version information")
@@ -24,31 +57,258 @@ func main() {
 	conversationId := flag.String("conversation-id", "", "ID for the conversation to be downloaded")
 	downloadVideos := flag.Bool("download-videos", false, "To download videos in the conversation")
 	downloadPhotos := flag.Bool("download-photos", false, "To download photos in the conversation")
+	downloadGifs := flag.Bool("download-gifs", false, "To download GIFs in the conversation, saved as mp4")
+	downloadSharedMedia := flag.Bool("download-shared-media", false, "To download the media of shared tweets and the thumbnails of link previews")
+	downloadVoice := flag.Bool("download-voice", false, "To download voice messages in the conversation")
+	outputDir := flag.String("output", dlmanager.CONVER_DIR, "Directory under which the conversations are archived")
+	mediaTemplate := flag.String("media-template", dlmanager.DEFAULT_MEDIA_TEMPLATE, "Path of each media file relative to the output directory\n"+
+		"Variables: {conversation} {year} {month} {day} {hour} {minute} {second} {date}\n"+
+		"{sender_id} {sender_screen_name} {message_id} {media_id} {media_type} {media_dir} {bitrate} {ext} {filename}")
+	videoQuality := flag.String("video-quality", dlmanager.DEFAULT_VIDEO_QUALITY, "Which variants of each video to download: highest, lowest, max-bitrate=N (bits per second) or all")
+	timezone := flag.String("timezone", "UTC", "Time zone used for the dates in media paths, e.g. Europe/Berlin or Local")
+	dedup := flag.Bool("dedup", false, "Store media once in a content-addressed store shared by all conversations")
+	storage := flag.String("storage", dlmanager.STORAGE_DIR, "Where events and media are written: dir, tar, tar.gz or zip")
+	encrypt := flag.Bool("encrypt", false, "Encrypt the events and media with AES-GCM, using a passphrase\n"+
+		"from the "+PASSPHRASE_ENV+" environment variable or the prompt, or the key in --key-file")
+	keyFile := flag.String("key-file", "", "With --encrypt, file holding at least 32 random bytes used as the key instead of a passphrase")
+	compressEvents := flag.Bool("compress-events", false, "Save event pages gzip compressed, as .json.gz")
+	exportFormat := flag.String("export-format", dlmanager.EXPORT_TEXT, "With export, format of the export: text or html")
+	exportFile := flag.String("export-file", "", "With export, file the export is written to, required for encrypted conversations (default {output}/{conversation}/export.txt or .html)")
+	fix := flag.Bool("fix", false, "With verify, re-download the missing, empty and truncated media")
 	authHeaderPath := flag.String("auth-headers", "./auth.txt", "File path to authorization headers to be passed to each request\n"+
 		"Headers are newline seperated, each header key value are colon seperated\n"+
 		"Example file:\n\tCookie: ABCD\n\tContent-Type: application/json")
-	flag.Parse()
+
+	command := CMD_ARCHIVE
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	if *showVersion {
 		fmt.Printf("%s version %s\n", os.Args[0], version)
 		os.Exit(0)
 	}
 
-	if *conversationId == "" {
+	if *conversationId == "" && command != CMD_GC && command != CMD_STATS {
 		fmt.Print("Missing --conversation-id argument.\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	twitterContext := twitter.InitTwitterContext(*conversationId, *authHeaderPath)
-	dlManager, err := dlmanager.InitDLManager(*conversationId, twitterContext, dlmanager.Options{
-		IsDebug:        *isDebug,
-		DownloadVideos: *downloadVideos,
-		DownloadPhotos: *downloadPhotos,
-	})
+	template, err := dlmanager.ParseMediaTemplate(*mediaTemplate)
+	if err != nil {
+		fmt.Printf("Invalid --media-template: %v\n", err)
+		os.Exit(1)
+	}
+	quality, err := dlmanager.ParseVideoQuality(*videoQuality)
+	if err != nil {
+		fmt.Printf("Invalid --video-quality: %v\n", err)
+		os.Exit(1)
+	}
+	err = template.CheckVideoQuality(quality)
 	if err != nil {
-		logger.MediaLogger.Fatalf("Failed to init DLManager %+v", dlManager)
+		fmt.Printf("Invalid --video-quality: %v\n", err)
+		os.Exit(1)
+	}
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		fmt.Printf("Invalid --timezone: %v\n", err)
+		os.Exit(1)
+	}
+	options := dlmanager.Options{
+		IsDebug:             *isDebug,
+		DownloadVideos:      *downloadVideos,
+		DownloadPhotos:      *downloadPhotos,
+		DownloadGifs:        *downloadGifs,
+		DownloadSharedMedia: *downloadSharedMedia,
+		DownloadVoice:       *downloadVoice,
+		OutputDir:           *outputDir,
+		MediaTemplate:       template,
+		VideoQuality:        quality,
+		Location:            location,
+		Dedup:               *dedup,
+		Storage:             *storage,
+		Encrypt:             *encrypt,
+		KeyFile:             *keyFile,
+		CompressEvents:      *compressEvents,
+	}
+	if *encrypt && *keyFile == "" && command != CMD_GC && (command != CMD_STATS || *conversationId != "") {
+		options.Passphrase, err = readPassphrase()
+		if err != nil {
+			fmt.Printf("Failed to read the passphrase: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	switch command {
+	case CMD_ARCHIVE:
+		twitterContext := twitter.InitTwitterContext(*conversationId, *authHeaderPath)
+		dlManager, err := dlmanager.InitDLManager(*conversationId, twitterContext, options)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to init DLManager: %v\n", err)
+		}
+		dlManager.Start()
+		dlManager.Close()
+	case CMD_RETRY_FAILED:
+		twitterContext := twitter.InitTwitterContext(*conversationId, *authHeaderPath)
+		options.DownloadPhotos = false
+		options.DownloadVideos = false
+		options.DownloadGifs = false
+		options.DownloadSharedMedia = false
+		options.DownloadVoice = false
+		dlManager, err := dlmanager.OpenDLManager(*conversationId, twitterContext, options)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to init DLManager: %v\n", err)
+		}
+		remaining := dlManager.RetryFailed()
+		dlManager.Close()
+		if remaining > 0 {
+			logger.MediaLogger.Printf("%d downloads are still failing, see %s\n", remaining, dlManager.Failures.Location())
+			os.Exit(1)
+		}
+	case CMD_VERIFY:
+		// Without an explicit selection every media type is expected.
+		if !options.DownloadPhotos && !options.DownloadVideos && !options.DownloadGifs && !options.DownloadSharedMedia && !options.DownloadVoice {
+			options.DownloadPhotos = true
+			options.DownloadVideos = true
+			options.DownloadGifs = true
+			options.DownloadSharedMedia = true
+			options.DownloadVoice = true
+		}
+		var twitterContext twitter.TwitterContext
+		if *fix {
+			twitterContext = twitter.InitTwitterContext(*conversationId, *authHeaderPath)
+		}
+		dlManager, err := dlmanager.OpenDLManager(*conversationId, twitterContext, options)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to init DLManager: %v\n", err)
+		}
+		report, err := dlManager.Verify()
+		if err != nil {
+			dlManager.Close()
+			logger.EventsLogger.Fatalf("Failed to verify conversation: %v\n", err)
+		}
+		report.Print()
+		problems := report.Problems()
+		if *fix && (len(report.MissingMedia) > 0 || len(report.BrokenMedia) > 0) {
+			failed := dlManager.FixVerifyProblems(report)
+			problems = problems - len(report.MissingMedia) - len(report.BrokenMedia) + failed
+			logger.MediaLogger.Printf("%d problems left after fixing\n", problems)
+		}
+		dlManager.Close()
+		if problems > 0 {
+			os.Exit(1)
+		}
+	case CMD_MIGRATE:
+		dlManager, err := dlmanager.OpenDLManager(*conversationId, twitter.TwitterContext{}, options)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to init DLManager: %v\n", err)
+		}
+		report, err := dlManager.MigrateLayout()
+		dlManager.Close()
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to migrate conversation: %v\n", err)
+		}
+		report.Print()
+		if len(report.Failed) > 0 {
+			os.Exit(1)
+		}
+	case CMD_COMPRESS:
+		dlManager, err := dlmanager.OpenDLManager(*conversationId, twitter.TwitterContext{}, options)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to init DLManager: %v\n", err)
+		}
+		report, err := dlManager.CompressEvents()
+		dlManager.Close()
+		if err != nil {
+			logger.EventsLogger.Fatalf("Failed to compress events: %v\n", err)
+		}
+		report.Print()
+	case CMD_COMPACT:
+		dlManager, err := dlmanager.OpenDLManager(*conversationId, twitter.TwitterContext{}, options)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to init DLManager: %v\n", err)
+		}
+		report, err := dlManager.Compact()
+		dlManager.Close()
+		if err != nil {
+			logger.EventsLogger.Fatalf("Failed to compact events: %v\n", err)
+		}
+		report.Print()
+	case CMD_EXPORT:
+		dlManager, err := dlmanager.OpenDLManager(*conversationId, twitter.TwitterContext{}, options)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to init DLManager: %v\n", err)
+		}
+		report, err := dlManager.Export(*exportFormat, *exportFile)
+		dlManager.Close()
+		if err != nil {
+			logger.EventsLogger.Fatalf("Failed to export conversation: %v\n", err)
+		}
+		report.Print()
+	case CMD_GC:
+		removed, freed, err := dlmanager.NewBlobStore(*outputDir).GC(*outputDir)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to collect unreferenced media: %v\n", err)
+		}
+		logger.MediaLogger.Printf("Removed %d unreferenced media files, freeing %s\n", removed, utils.FormatBytes(freed))
+	case CMD_STATS:
+		stats, err := dlmanager.NewBlobStore(*outputDir).Stats(*outputDir)
+		if err != nil {
+			logger.MediaLogger.Fatalf("Failed to compute stats: %v\n", err)
+		}
+		logger.MediaLogger.Printf("Deduplicated media files: %d (%s)\n", stats.Blobs, utils.FormatBytes(stats.BlobBytes))
+		logger.MediaLogger.Printf("References from conversations: %d (%s)\n", stats.References, utils.FormatBytes(stats.ReferencedBytes))
+		logger.MediaLogger.Printf("Unreferenced media files: %d\n", stats.UnreferencedBlobs)
+		logger.MediaLogger.Printf("Space saved by deduplication: %s\n", utils.FormatBytes(stats.SavedBytes))
+		if *conversationId != "" {
+			dlManager, err := dlmanager.OpenDLManager(*conversationId, twitter.TwitterContext{}, options)
+			if err != nil {
+				logger.MediaLogger.Fatalf("Failed to init DLManager: %v\n", err)
+			}
+			err = dlManager.LoadEntries()
+			dlManager.Close()
+			if err != nil {
+				logger.EventsLogger.Fatalf("Failed to load entries: %v\n", err)
+			}
+			dlManager.EntryStats().Print()
+		}
+	default:
+		fmt.Printf("Unknown command %s.\n", command)
+		flag.Usage()
+		os.Exit(1)
 	}
-	dlManager.Start()
 	logger.MediaLogger.Printf("Done\n")
 }
+
+// readPassphrase takes the passphrase from the environment, so it can be given
+// non-interactively, or asks for it on the terminal without echoing it. Input
+// that is not a terminal, such as a pipe, is read as a line.
+func readPassphrase() (string, error) {
+	if passphrase := os.Getenv(PASSPHRASE_ENV); passphrase != "" {
+		return passphrase, nil
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	var passphrase string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		line, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		passphrase = string(line)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		passphrase = strings.TrimRight(line, "\r\n")
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("the passphrase is empty")
+	}
+	return passphrase, nil
+}
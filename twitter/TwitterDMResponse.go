@@ -3,11 +3,16 @@ package twitter
 import (
 	"XDMArchiver/logger"
 	"XDMArchiver/utils"
+	"encoding/json"
+	"strconv"
 )
 
 // Root structure for the entire response
 type ConversationResponse struct {
 	ConversationTimeline ConversationTimeline `json:"conversation_timeline"`
+	// Raw holds the response exactly as it was received, including every field
+	// that is not modeled here.
+	Raw []byte `json:"-"`
 }
 
 /*
@@ -50,54 +55,189 @@ type User struct {
 	IsTranslator           bool                   `json:"is_translator"`
 	IsTranslationEnabled   bool                   `json:"is_translation_enabled"`
 	ProfileBackgroundColor string                 `json:"profile_background_color"`
+	Raw                    json.RawMessage        `json:"-"`
 }
 
-// Entry represents a message in the conversation
-type Entry struct {
-	Message Message `json:"message"`
+type userFields User
+
+// UnmarshalJSON keeps the original JSON of the user, so encoding it again does
+// not drop the fields that are not modeled.
+func (user *User) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, (*userFields)(user))
+	if err != nil {
+		return err
+	}
+	user.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (user User) MarshalJSON() ([]byte, error) {
+	if len(user.Raw) > 0 {
+		return user.Raw, nil
+	}
+	return json.Marshal(userFields(user))
 }
 
 // Message contains the actual message data
 type Message struct {
-	Time        string      `json:"time"`
+	EntryHeader
 	MessageData MessageData `json:"message_data"`
+	// Reactions are the reactions the message had when it was fetched.
+	Reactions []ReactionEvent `json:"message_reactions,omitempty"`
+	// ReplyTo is the archived message this one replies to, resolved once the
+	// entries of the conversation are loaded.
+	ReplyTo *Message `json:"-"`
 }
 
 // MessageData contains the content of the message
 type MessageData struct {
+	ID         string      `json:"id"`
 	Time       string      `json:"time"`
 	SenderID   string      `json:"sender_id"`
 	Text       string      `json:"text"`
 	Attachment *Attachment `json:"attachment"`
+	ReplyData  *ReplyData  `json:"reply_data,omitempty"`
+	Entities   *Entities   `json:"entities,omitempty"`
+	// EditCount and EditedAt are only set on edited messages.
+	EditCount NumberOrString `json:"edit_count,omitempty"`
+	EditedAt  NumberOrString `json:"edited_at,omitempty"`
+	// EditHistory holds the previous versions of the message, when the API
+	// returns them.
+	EditHistory []MessageEdit `json:"edit_history,omitempty"`
+}
+
+// ReplyData identifies the message a reply is for, with a preview of its text.
+type ReplyData struct {
+	ID       string         `json:"id"`
+	Time     NumberOrString `json:"time,omitempty"`
+	SenderID string         `json:"sender_id,omitempty"`
+	Text     string         `json:"text"`
+}
+
+type MessageEdit struct {
+	Text string         `json:"text"`
+	Time NumberOrString `json:"time,omitempty"`
+}
+
+// NumberOrString decodes a value the API sends either as a string or as a
+// number, such as timestamps and counts.
+type NumberOrString string
+
+func (value *NumberOrString) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*value = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		err := json.Unmarshal(data, &str)
+		if err != nil {
+			return err
+		}
+		*value = NumberOrString(str)
+		return nil
+	}
+	*value = NumberOrString(data)
+	return nil
+}
+
+// Edits returns the number of times the message was edited.
+func (data *MessageData) Edits() int {
+	count, err := strconv.Atoi(string(data.EditCount))
+	if err != nil {
+		return 0
+	}
+	return count
 }
 
 // Attachment contains information about attached content
 type Attachment struct {
 	Photo Photo `json:"photo"`
 	Video Video `json:"video"`
+	// AnimatedGif holds GIFs, which are delivered as mp4 videos.
+	AnimatedGif Video            `json:"animated_gif"`
+	Tweet       *TweetAttachment `json:"tweet,omitempty"`
+	Card        *Card            `json:"card,omitempty"`
 }
 
 // Video contains video metadata
 type Video struct {
+	IDStr         string `json:"id_str"`
 	MediaURLHTTPS string `json:"media_url_https"`
-	VideoInfo     struct {
-		Variants []struct {
+	// URL is the t.co link to the media appended to the text of the message.
+	URL string `json:"url,omitempty"`
+	// Type is video, or animated_gif for GIFs sent as a video.
+	Type string `json:"type,omitempty"`
+	// AudioOnly is set on voice messages, which are sent as a video.
+	AudioOnly bool `json:"audio_only,omitempty"`
+	VideoInfo struct {
+		DurationMillis int `json:"duration_millis,omitempty"`
+		Variants       []struct {
 			ContentType string `json:"content_type"`
 			URL         string `json:"url"`
 			Bitrate     int    `json:"bitrate,omitempty"`
 		} `json:"variants"`
 	} `json:"video_info"`
+	// Ext holds the extensions requested with the ext parameter.
+	Ext *MediaExt `json:"ext,omitempty"`
+}
+
+// MediaExt is the ext object of a media. Each extension is wrapped in an r
+// object, holding ok when the extension applies to the media.
+type MediaExt struct {
+	VoiceInfo *struct {
+		R struct {
+			Ok *VoiceInfo `json:"ok,omitempty"`
+		} `json:"r"`
+	} `json:"voiceInfo,omitempty"`
+}
+
+type VoiceInfo struct {
+	DurationMs int `json:"durationMs,omitempty"`
+}
+
+const (
+	MEDIA_ANIMATED_GIF = "animated_gif"
+)
+
+func (video *Video) voiceInfo() *VoiceInfo {
+	if video.Ext == nil || video.Ext.VoiceInfo == nil {
+		return nil
+	}
+	return video.Ext.VoiceInfo.R.Ok
+}
+
+// IsVoice tells whether the video is a voice message, which is flagged as
+// audio only or has voice info.
+func (video *Video) IsVoice() bool {
+	return video.AudioOnly || video.voiceInfo() != nil
+}
+
+// DurationMs returns the length of the video in milliseconds, 0 when unknown.
+func (video *Video) DurationMs() int {
+	if video.VideoInfo.DurationMillis > 0 {
+		return video.VideoInfo.DurationMillis
+	}
+	if info := video.voiceInfo(); info != nil {
+		return info.DurationMs
+	}
+	return 0
 }
 
 // Photo contains photo metadata
 type Photo struct {
+	IDStr         string `json:"id_str"`
 	MediaURLHTTPS string `json:"media_url_https"`
+	// URL is the t.co link to the media appended to the text of the message.
+	URL string `json:"url,omitempty"`
 }
 
+// GetEntries returns the message entries of the response. The continuation
+// chain and the cursor are only built from messages.
 func (res *ConversationResponse) GetEntries() []Entry {
 	filteredEntries := make([]Entry, 0)
 	for _, entry := range res.ConversationTimeline.Entries {
-		if entry.Message.Time != "" {
+		if entry.Message != nil && entry.Message.Time != "" {
 			filteredEntries = append(filteredEntries, entry)
 		}
 	}
@@ -120,7 +260,19 @@ func (res *ConversationResponse) GetMinEntry() Entry {
 	return entries[len(entries)-1]
 }
 
+// GetMessageId returns the snowflake id of the message, which is also the id
+// of the message_data for messages created by a user.
+func (entry *Entry) GetMessageId() string {
+	if entry.Message == nil {
+		return ""
+	}
+	if entry.Message.ID != "" {
+		return entry.Message.ID
+	}
+	return entry.Message.MessageData.ID
+}
+
 func (entry *Entry) GetEntryId() string {
-	t, _ := utils.UnixTimestampStringToTime(entry.Message.Time, true)
+	t, _ := utils.UnixTimestampStringToTime(entry.Time(), true)
 	return EncodeFakeSnowflakeFromTimestamp(*t)
 }
@@ -39,6 +39,7 @@ func deserializeEvent(response []byte) (*ConversationResponse, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing JSON: %v", err)
 	}
+	responseJson.Raw = response
 
 	return &responseJson, nil
 }
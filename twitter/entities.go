@@ -0,0 +1,220 @@
+package twitter
+
+import (
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Entities are the links, mentions, hashtags and cashtags found in the text of
+// a message.
+type Entities struct {
+	URLs         []URLEntity     `json:"urls,omitempty"`
+	UserMentions []MentionEntity `json:"user_mentions,omitempty"`
+	Hashtags     []HashtagEntity `json:"hashtags,omitempty"`
+	Symbols      []HashtagEntity `json:"symbols,omitempty"`
+}
+
+// URLEntity is a t.co link of the text along with the link it stands for.
+type URLEntity struct {
+	URL         string `json:"url"`
+	ExpandedURL string `json:"expanded_url"`
+	DisplayURL  string `json:"display_url"`
+	Indices     []int  `json:"indices,omitempty"`
+}
+
+type MentionEntity struct {
+	IDStr      string `json:"id_str"`
+	ScreenName string `json:"screen_name"`
+	Name       string `json:"name"`
+	Indices    []int  `json:"indices,omitempty"`
+}
+
+// HashtagEntity is used by hashtags and by symbols, the $cashtags.
+type HashtagEntity struct {
+	Text    string `json:"text"`
+	Indices []int  `json:"indices,omitempty"`
+}
+
+const (
+	X_URL = "https://x.com"
+)
+
+// ExpandURL returns the link a t.co link of the text stands for, or the link
+// itself when it is not one of its entities.
+func (data *MessageData) ExpandURL(link string) string {
+	if data.Entities != nil {
+		for _, entity := range data.Entities.URLs {
+			if entity.URL == link && entity.ExpandedURL != "" {
+				return entity.ExpandedURL
+			}
+		}
+	}
+	return link
+}
+
+// textSpan is a part of the text that an entity replaces.
+type textSpan struct {
+	start, end int
+	plain      string
+	link       string
+	label      string
+}
+
+// findToken returns the positions of token in text, ignoring case and skipping
+// the ones that are part of a longer word when wordOnly is set.
+func findToken(text string, token string, wordOnly bool) [][2]int {
+	positions := make([][2]int, 0)
+	if token == "" {
+		return positions
+	}
+	for start := 0; start+len(token) <= len(text); start++ {
+		end := start + len(token)
+		if text[start] != token[0] || !strings.EqualFold(text[start:end], token) {
+			continue
+		}
+		if wordOnly && (isWordRuneBefore(text, start) || isWordRuneAfter(text, end)) {
+			continue
+		}
+		positions = append(positions, [2]int{start, end})
+		start = end - 1
+	}
+	return positions
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isWordRuneBefore(text string, position int) bool {
+	r, size := utf8.DecodeLastRuneInString(text[:position])
+	return size > 0 && isWordRune(r)
+}
+
+func isWordRuneAfter(text string, position int) bool {
+	r, size := utf8.DecodeRuneInString(text[position:])
+	return size > 0 && isWordRune(r)
+}
+
+// spans finds where the entities are in the text. Entities are looked up by
+// their text rather than by their indices, which count characters of the text
+// before or after escaping depending on the client that sent it.
+func (data *MessageData) spans() []textSpan {
+	spans := make([]textSpan, 0)
+	add := func(token string, wordOnly bool, entity textSpan) {
+		for _, position := range findToken(data.Text, token, wordOnly) {
+			span := entity
+			span.start, span.end = position[0], position[1]
+			// Mentions, hashtags and cashtags are kept as they were typed.
+			if span.link != "" && span.plain == "" {
+				span.plain = data.Text[span.start:span.end]
+			}
+			if span.link != "" && span.label == "" {
+				span.label = data.Text[span.start:span.end]
+			}
+			spans = append(spans, span)
+		}
+	}
+
+	// Links to the attachment are dropped, the media or tweet is shown instead.
+	if data.Attachment != nil {
+		links := []string{data.Attachment.Photo.URL, data.Attachment.Video.URL, data.Attachment.AnimatedGif.URL}
+		if data.Attachment.Tweet != nil {
+			links = append(links, data.Attachment.Tweet.URL)
+		}
+		for _, link := range links {
+			add(link, false, textSpan{})
+		}
+	}
+	if data.Entities != nil {
+		for _, link := range data.Entities.URLs {
+			expanded := link.ExpandedURL
+			if expanded == "" {
+				expanded = link.URL
+			}
+			label := link.DisplayURL
+			if label == "" {
+				label = expanded
+			}
+			add(link.URL, false, textSpan{plain: expanded, link: expanded, label: label})
+		}
+		for _, mention := range data.Entities.UserMentions {
+			add("@"+mention.ScreenName, true, textSpan{link: X_URL + "/" + mention.ScreenName})
+		}
+		for _, hashtag := range data.Entities.Hashtags {
+			add("#"+hashtag.Text, true, textSpan{link: X_URL + "/hashtag/" + url.PathEscape(hashtag.Text)})
+		}
+		for _, symbol := range data.Entities.Symbols {
+			add("$"+symbol.Text, true, textSpan{link: X_URL + "/search?q=" + url.QueryEscape("$"+symbol.Text)})
+		}
+	}
+
+	// The first of overlapping entities wins, attachment links first.
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	kept := spans[:0]
+	end := 0
+	for _, span := range spans {
+		if span.start >= end {
+			kept = append(kept, span)
+			end = span.end
+		}
+	}
+	return kept
+}
+
+// render writes the text with each entity replaced, and the text between them
+// passed through outside.
+func (data *MessageData) render(outside func(string) string, entity func(textSpan) string) string {
+	var builder strings.Builder
+	position := 0
+	for _, span := range data.spans() {
+		builder.WriteString(outside(data.Text[position:span.start]))
+		builder.WriteString(entity(span))
+		position = span.end
+	}
+	builder.WriteString(outside(data.Text[position:]))
+	return strings.TrimSpace(builder.String())
+}
+
+// PlainText returns the text of the message with the t.co links expanded, the
+// link to the attachment removed and the HTML entities unescaped.
+func (data *MessageData) PlainText() string {
+	return data.render(html.UnescapeString, func(span textSpan) string {
+		return span.plain
+	})
+}
+
+// isWebLink reports whether link is an absolute http or https URL. The
+// expanded links come from the sender, so other schemes such as javascript:
+// are not linked to.
+func isWebLink(link string) bool {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	scheme := strings.ToLower(parsed.Scheme)
+	return (scheme == "http" || scheme == "https") && parsed.Host != ""
+}
+
+// RichText returns the text of the message as HTML, with links for the URLs,
+// mentions, hashtags and cashtags, and the link to the attachment removed.
+// Links that are not http or https are shown as text.
+func (data *MessageData) RichText() string {
+	escape := func(text string) string {
+		return html.EscapeString(html.UnescapeString(text))
+	}
+	return data.render(escape, func(span textSpan) string {
+		if span.link == "" {
+			return ""
+		}
+		if !isWebLink(span.link) {
+			return escape(span.label)
+		}
+		return `<a href="` + html.EscapeString(span.link) + `">` + escape(span.label) + `</a>`
+	})
+}
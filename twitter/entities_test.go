@@ -0,0 +1,44 @@
+package twitter
+
+import "testing"
+
+func TestRichText(t *testing.T) {
+	tests := []struct {
+		name string
+		data MessageData
+		want string
+	}{
+		{
+			"link",
+			MessageData{Text: "see https://t.co/a", Entities: &Entities{URLs: []URLEntity{{URL: "https://t.co/a", ExpandedURL: "https://example.com/?a=1&b=2", DisplayURL: "example.com"}}}},
+			`see <a href="https://example.com/?a=1&amp;b=2">example.com</a>`,
+		},
+		{
+			"javascript link",
+			MessageData{Text: "see https://t.co/a", Entities: &Entities{URLs: []URLEntity{{URL: "https://t.co/a", ExpandedURL: "javascript:alert(1)", DisplayURL: "<b>click</b>"}}}},
+			`see &lt;b&gt;click&lt;/b&gt;`,
+		},
+		{
+			"data link",
+			MessageData{Text: "https://t.co/a", Entities: &Entities{URLs: []URLEntity{{URL: "https://t.co/a", ExpandedURL: "data:text/html,<script>alert(1)</script>"}}}},
+			`data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;`,
+		},
+		{
+			"quotes in the link",
+			MessageData{Text: "https://t.co/a", Entities: &Entities{URLs: []URLEntity{{URL: "https://t.co/a", ExpandedURL: `https://example.com/" onmouseover="alert(1)`, DisplayURL: "example.com"}}}},
+			`<a href="https://example.com/&#34; onmouseover=&#34;alert(1)">example.com</a>`,
+		},
+		{
+			"mention and hashtag",
+			MessageData{Text: "hi @bob #go <3", Entities: &Entities{UserMentions: []MentionEntity{{ScreenName: "bob"}}, Hashtags: []HashtagEntity{{Text: "go"}}}},
+			`hi <a href="https://x.com/bob">@bob</a> <a href="https://x.com/hashtag/go">#go</a> &lt;3`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.data.RichText(); got != test.want {
+				t.Errorf("RichText() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
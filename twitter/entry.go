@@ -0,0 +1,261 @@
+package twitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Kinds of entries of a DM conversation timeline. Each entry is a JSON object
+// with a single key naming its kind.
+const (
+	ENTRY_MESSAGE                    = "message"
+	ENTRY_PARTICIPANTS_JOIN          = "participants_join"
+	ENTRY_PARTICIPANTS_LEAVE         = "participants_leave"
+	ENTRY_JOIN_CONVERSATION          = "join_conversation"
+	ENTRY_CONVERSATION_CREATE        = "conversation_create"
+	ENTRY_CONVERSATION_NAME_UPDATE   = "conversation_name_update"
+	ENTRY_CONVERSATION_AVATAR_UPDATE = "conversation_avatar_update"
+	ENTRY_MESSAGE_DELETE             = "message_delete"
+	ENTRY_TRUST_CONVERSATION         = "trust_conversation"
+	ENTRY_REACTION_CREATE            = "reaction_create"
+	ENTRY_REACTION_DELETE            = "reaction_delete"
+	ENTRY_DISABLE_NOTIFICATIONS      = "disable_notifications"
+	ENTRY_ENABLE_NOTIFICATIONS       = "enable_notifications"
+	ENTRY_CONVERSATION_READ          = "conversation_read"
+	ENTRY_UNKNOWN                    = "unknown"
+)
+
+// EntryHeader holds the fields shared by every kind of entry.
+type EntryHeader struct {
+	ID             string `json:"id"`
+	Time           string `json:"time"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	AffectsSort    bool   `json:"affects_sort,omitempty"`
+}
+
+type Participant struct {
+	UserID string `json:"user_id"`
+}
+
+// ParticipantsChange is used by participants_join, participants_leave and
+// join_conversation entries.
+type ParticipantsChange struct {
+	EntryHeader
+	SenderID     string        `json:"sender_id"`
+	Participants []Participant `json:"participants"`
+}
+
+// ConversationEvent is used by the entries that only tell who did something:
+// conversation_create, disable_notifications, enable_notifications and
+// conversation_read.
+type ConversationEvent struct {
+	EntryHeader
+	SenderID        string `json:"sender_id,omitempty"`
+	ByUserID        string `json:"by_user_id,omitempty"`
+	LastReadEventID string `json:"last_read_event_id,omitempty"`
+}
+
+type ConversationNameUpdate struct {
+	EntryHeader
+	ConversationName string `json:"conversation_name"`
+	ByUserID         string `json:"by_user_id"`
+}
+
+type ConversationAvatarUpdate struct {
+	EntryHeader
+	AvatarURLHTTPS string `json:"conversation_avatar_image_https"`
+	ByUserID       string `json:"by_user_id"`
+}
+
+type DeletedMessage struct {
+	MessageID            string `json:"message_id"`
+	MessageCreateEventID string `json:"message_create_event_id"`
+}
+
+type MessageDelete struct {
+	EntryHeader
+	Messages []DeletedMessage `json:"messages"`
+}
+
+type TrustConversation struct {
+	EntryHeader
+	Reason string `json:"reason"`
+}
+
+// ReactionEvent is used by reaction_create and reaction_delete entries, and for
+// the reactions listed in a message.
+type ReactionEvent struct {
+	EntryHeader
+	MessageID     string `json:"message_id"`
+	ReactionKey   string `json:"reaction_key"`
+	EmojiReaction string `json:"emoji_reaction"`
+	SenderID      string `json:"sender_id"`
+}
+
+// Entry is one item of a conversation timeline. Exactly one of the variants is
+// set, as named by Type. Entries of a kind that is not modeled have the
+// ENTRY_UNKNOWN type, their header in Unknown and their kind in UnknownType;
+// Raw always holds the original JSON.
+type Entry struct {
+	Type                     string                    `json:"-"`
+	Message                  *Message                  `json:"message,omitempty"`
+	ParticipantsJoin         *ParticipantsChange       `json:"participants_join,omitempty"`
+	ParticipantsLeave        *ParticipantsChange       `json:"participants_leave,omitempty"`
+	JoinConversation         *ParticipantsChange       `json:"join_conversation,omitempty"`
+	ConversationCreate       *ConversationEvent        `json:"conversation_create,omitempty"`
+	ConversationNameUpdate   *ConversationNameUpdate   `json:"conversation_name_update,omitempty"`
+	ConversationAvatarUpdate *ConversationAvatarUpdate `json:"conversation_avatar_update,omitempty"`
+	MessageDelete            *MessageDelete            `json:"message_delete,omitempty"`
+	TrustConversation        *TrustConversation        `json:"trust_conversation,omitempty"`
+	ReactionCreate           *ReactionEvent            `json:"reaction_create,omitempty"`
+	ReactionDelete           *ReactionEvent            `json:"reaction_delete,omitempty"`
+	DisableNotifications     *ConversationEvent        `json:"disable_notifications,omitempty"`
+	EnableNotifications      *ConversationEvent        `json:"enable_notifications,omitempty"`
+	ConversationRead         *ConversationEvent        `json:"conversation_read,omitempty"`
+	Unknown                  *EntryHeader              `json:"-"`
+	UnknownType              string                    `json:"-"`
+	Raw                      json.RawMessage           `json:"-"`
+}
+
+type entryFields Entry
+
+// Header returns the fields shared by every kind of entry.
+func (entry *Entry) Header() EntryHeader {
+	if entry.Type == "" {
+		entry.setType()
+	}
+	switch entry.Type {
+	case ENTRY_MESSAGE:
+		return entry.Message.EntryHeader
+	case ENTRY_PARTICIPANTS_JOIN:
+		return entry.ParticipantsJoin.EntryHeader
+	case ENTRY_PARTICIPANTS_LEAVE:
+		return entry.ParticipantsLeave.EntryHeader
+	case ENTRY_JOIN_CONVERSATION:
+		return entry.JoinConversation.EntryHeader
+	case ENTRY_CONVERSATION_CREATE:
+		return entry.ConversationCreate.EntryHeader
+	case ENTRY_CONVERSATION_NAME_UPDATE:
+		return entry.ConversationNameUpdate.EntryHeader
+	case ENTRY_CONVERSATION_AVATAR_UPDATE:
+		return entry.ConversationAvatarUpdate.EntryHeader
+	case ENTRY_MESSAGE_DELETE:
+		return entry.MessageDelete.EntryHeader
+	case ENTRY_TRUST_CONVERSATION:
+		return entry.TrustConversation.EntryHeader
+	case ENTRY_REACTION_CREATE:
+		return entry.ReactionCreate.EntryHeader
+	case ENTRY_REACTION_DELETE:
+		return entry.ReactionDelete.EntryHeader
+	case ENTRY_DISABLE_NOTIFICATIONS:
+		return entry.DisableNotifications.EntryHeader
+	case ENTRY_ENABLE_NOTIFICATIONS:
+		return entry.EnableNotifications.EntryHeader
+	case ENTRY_CONVERSATION_READ:
+		return entry.ConversationRead.EntryHeader
+	case ENTRY_UNKNOWN:
+		if entry.Unknown != nil {
+			return *entry.Unknown
+		}
+	}
+	return EntryHeader{}
+}
+
+func (entry *Entry) ID() string {
+	return entry.Header().ID
+}
+
+func (entry *Entry) Time() string {
+	return entry.Header().Time
+}
+
+// IsSystem reports whether the entry is an event of the conversation rather
+// than a message.
+func (entry *Entry) IsSystem() bool {
+	return entry.Type != ENTRY_MESSAGE
+}
+
+// setType finds which variant was decoded.
+func (entry *Entry) setType() {
+	variants := []struct {
+		name string
+		set  bool
+	}{
+		{ENTRY_MESSAGE, entry.Message != nil},
+		{ENTRY_PARTICIPANTS_JOIN, entry.ParticipantsJoin != nil},
+		{ENTRY_PARTICIPANTS_LEAVE, entry.ParticipantsLeave != nil},
+		{ENTRY_JOIN_CONVERSATION, entry.JoinConversation != nil},
+		{ENTRY_CONVERSATION_CREATE, entry.ConversationCreate != nil},
+		{ENTRY_CONVERSATION_NAME_UPDATE, entry.ConversationNameUpdate != nil},
+		{ENTRY_CONVERSATION_AVATAR_UPDATE, entry.ConversationAvatarUpdate != nil},
+		{ENTRY_MESSAGE_DELETE, entry.MessageDelete != nil},
+		{ENTRY_TRUST_CONVERSATION, entry.TrustConversation != nil},
+		{ENTRY_REACTION_CREATE, entry.ReactionCreate != nil},
+		{ENTRY_REACTION_DELETE, entry.ReactionDelete != nil},
+		{ENTRY_DISABLE_NOTIFICATIONS, entry.DisableNotifications != nil},
+		{ENTRY_ENABLE_NOTIFICATIONS, entry.EnableNotifications != nil},
+		{ENTRY_CONVERSATION_READ, entry.ConversationRead != nil},
+	}
+	for _, variant := range variants {
+		if variant.set {
+			entry.Type = variant.name
+			return
+		}
+	}
+	entry.Type = ENTRY_UNKNOWN
+}
+
+// UnmarshalJSON decodes the variant named by the key of the entry and keeps
+// the original JSON, so encoding it again does not drop the fields that are not
+// modeled.
+func (entry *Entry) UnmarshalJSON(data []byte) error {
+	*entry = Entry{}
+	err := json.Unmarshal(data, (*entryFields)(entry))
+	if err != nil {
+		return err
+	}
+	entry.Raw = append(json.RawMessage(nil), data...)
+	entry.setType()
+	if entry.Type != ENTRY_UNKNOWN {
+		return nil
+	}
+
+	var variants map[string]json.RawMessage
+	err = json.Unmarshal(data, &variants)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(variants))
+	for key := range variants {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("empty timeline entry")
+	}
+	sort.Strings(keys)
+	entry.UnknownType = keys[0]
+	entry.Unknown = &EntryHeader{}
+	// The content of unknown entries may not be an object with a header.
+	json.Unmarshal(variants[keys[0]], entry.Unknown)
+	return nil
+}
+
+func (entry Entry) MarshalJSON() ([]byte, error) {
+	if len(entry.Raw) > 0 {
+		return entry.Raw, nil
+	}
+	return json.Marshal(entryFields(entry))
+}
+
+// GetTimelineEntries returns every entry of the response that has a time,
+// messages and conversation events alike, newest first.
+func (res *ConversationResponse) GetTimelineEntries() []Entry {
+	entries := make([]Entry, 0, len(res.ConversationTimeline.Entries))
+	for _, entry := range res.ConversationTimeline.Entries {
+		if entry.Time() != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
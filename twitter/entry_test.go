@@ -0,0 +1,83 @@
+package twitter
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEntryUnmarshal(t *testing.T) {
+	tests := []struct {
+		json  string
+		kind  string
+		check func(entry Entry) bool
+	}{
+		{`{"message":{"id":"10","time":"1000","message_data":{"id":"10","time":"1000","sender_id":"5","text":"hi"}}}`, ENTRY_MESSAGE,
+			func(entry Entry) bool { return entry.Message.MessageData.Text == "hi" }},
+		{`{"participants_join":{"id":"10","time":"1000","sender_id":"5","participants":[{"user_id":"6"}]}}`, ENTRY_PARTICIPANTS_JOIN,
+			func(entry Entry) bool { return entry.ParticipantsJoin.Participants[0].UserID == "6" }},
+		{`{"participants_leave":{"id":"10","time":"1000","participants":[{"user_id":"6"}]}}`, ENTRY_PARTICIPANTS_LEAVE,
+			func(entry Entry) bool { return entry.ParticipantsLeave.Participants[0].UserID == "6" }},
+		{`{"join_conversation":{"id":"10","time":"1000","sender_id":"5","participants":[]}}`, ENTRY_JOIN_CONVERSATION,
+			func(entry Entry) bool { return entry.JoinConversation.SenderID == "5" }},
+		{`{"conversation_create":{"id":"10","time":"1000","conversation_id":"5-6"}}`, ENTRY_CONVERSATION_CREATE,
+			func(entry Entry) bool { return entry.ConversationCreate.ConversationID == "5-6" }},
+		{`{"conversation_name_update":{"id":"10","time":"1000","conversation_name":"friends","by_user_id":"5"}}`, ENTRY_CONVERSATION_NAME_UPDATE,
+			func(entry Entry) bool { return entry.ConversationNameUpdate.ConversationName == "friends" }},
+		{`{"conversation_avatar_update":{"id":"10","time":"1000","conversation_avatar_image_https":"https://pbs.twimg.com/a.jpg","by_user_id":"5"}}`, ENTRY_CONVERSATION_AVATAR_UPDATE,
+			func(entry Entry) bool {
+				return entry.ConversationAvatarUpdate.AvatarURLHTTPS == "https://pbs.twimg.com/a.jpg"
+			}},
+		{`{"message_delete":{"id":"10","time":"1000","messages":[{"message_id":"9","message_create_event_id":"9"}]}}`, ENTRY_MESSAGE_DELETE,
+			func(entry Entry) bool { return entry.MessageDelete.Messages[0].MessageID == "9" }},
+		{`{"trust_conversation":{"id":"10","time":"1000","reason":"accept"}}`, ENTRY_TRUST_CONVERSATION,
+			func(entry Entry) bool { return entry.TrustConversation.Reason == "accept" }},
+		{`{"reaction_create":{"id":"10","time":"1000","message_id":"9","reaction_key":"like","emoji_reaction":"❤","sender_id":"5"}}`, ENTRY_REACTION_CREATE,
+			func(entry Entry) bool {
+				return entry.ReactionCreate.MessageID == "9" && entry.ReactionCreate.EmojiReaction == "❤"
+			}},
+		{`{"reaction_delete":{"id":"10","time":"1000","message_id":"9","reaction_key":"like","sender_id":"5"}}`, ENTRY_REACTION_DELETE,
+			func(entry Entry) bool { return entry.ReactionDelete.MessageID == "9" }},
+		{`{"disable_notifications":{"id":"10","time":"1000","by_user_id":"5"}}`, ENTRY_DISABLE_NOTIFICATIONS,
+			func(entry Entry) bool { return entry.DisableNotifications.ByUserID == "5" }},
+		{`{"enable_notifications":{"id":"10","time":"1000","by_user_id":"5"}}`, ENTRY_ENABLE_NOTIFICATIONS,
+			func(entry Entry) bool { return entry.EnableNotifications.ByUserID == "5" }},
+		{`{"conversation_read":{"id":"10","time":"1000","last_read_event_id":"9"}}`, ENTRY_CONVERSATION_READ,
+			func(entry Entry) bool { return entry.ConversationRead.LastReadEventID == "9" }},
+		{`{"poll_create":{"id":"10","time":"1000","question":"?"}}`, ENTRY_UNKNOWN,
+			func(entry Entry) bool { return entry.UnknownType == "poll_create" }},
+	}
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			var entry Entry
+			if err := json.Unmarshal([]byte(test.json), &entry); err != nil {
+				t.Fatalf("failed to decode entry: %v", err)
+			}
+			if entry.Type != test.kind {
+				t.Errorf("Type = %s, want %s", entry.Type, test.kind)
+			}
+			if entry.ID() != "10" || entry.Time() != "1000" {
+				t.Errorf("header = %+v, want id 10 and time 1000", entry.Header())
+			}
+			if entry.IsSystem() != (test.kind != ENTRY_MESSAGE) {
+				t.Errorf("IsSystem() = %v for a %s entry", entry.IsSystem(), test.kind)
+			}
+			if !test.check(entry) {
+				t.Errorf("the %s variant was not decoded: %s", test.kind, test.json)
+			}
+			encoded, err := json.Marshal(entry)
+			if err != nil {
+				t.Fatalf("failed to encode entry: %v", err)
+			}
+			if string(encoded) != test.json {
+				t.Errorf("encoded entry = %s, want the original %s", encoded, test.json)
+			}
+		})
+	}
+}
+
+func TestEntryUnmarshalRejectsEmpty(t *testing.T) {
+	var entry Entry
+	if err := json.Unmarshal([]byte(`{}`), &entry); err == nil {
+		t.Errorf("decoding an empty entry succeeded, want an error")
+	}
+}
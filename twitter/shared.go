@@ -0,0 +1,131 @@
+package twitter
+
+import (
+	"encoding/json"
+)
+
+// TweetAttachment is a tweet shared in a message.
+type TweetAttachment struct {
+	ID          NumberOrString `json:"id"`
+	URL         string         `json:"url"`
+	DisplayURL  string         `json:"display_url,omitempty"`
+	ExpandedURL string         `json:"expanded_url,omitempty"`
+	Status      *Tweet         `json:"status,omitempty"`
+}
+
+type Tweet struct {
+	IDStr     string    `json:"id_str"`
+	CreatedAt string    `json:"created_at"`
+	FullText  string    `json:"full_text,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	User      *User     `json:"user,omitempty"`
+	Entities  *Entities `json:"entities,omitempty"`
+	// ExtendedEntities lists every media of the tweet. Each has the shape of a
+	// video attachment, with Type telling photo, video or animated_gif.
+	ExtendedEntities *struct {
+		Media []Video `json:"media"`
+	} `json:"extended_entities,omitempty"`
+}
+
+// GetText returns the text of the tweet, which is in full_text for tweets
+// fetched in extended mode.
+func (tweet *Tweet) GetText() string {
+	if tweet.FullText != "" {
+		return tweet.FullText
+	}
+	return tweet.Text
+}
+
+// GetMedia returns the media of the tweet.
+func (tweet *Tweet) GetMedia() []Video {
+	if tweet.ExtendedEntities == nil {
+		return nil
+	}
+	return tweet.ExtendedEntities.Media
+}
+
+// Card is the preview of a link shared in a message.
+type Card struct {
+	Name          string       `json:"name"`
+	URL           string       `json:"url"`
+	BindingValues CardBindings `json:"binding_values"`
+}
+
+type CardValue struct {
+	Type        string     `json:"type"`
+	StringValue string     `json:"string_value,omitempty"`
+	ImageValue  *CardImage `json:"image_value,omitempty"`
+}
+
+type CardImage struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// CardBindings are the values of a card by name. They are sent as an object,
+// or as a list of key and value pairs by newer endpoints.
+type CardBindings map[string]CardValue
+
+func (bindings *CardBindings) UnmarshalJSON(data []byte) error {
+	values := make(map[string]CardValue)
+	if len(data) > 0 && data[0] == '[' {
+		var pairs []struct {
+			Key   string    `json:"key"`
+			Value CardValue `json:"value"`
+		}
+		err := json.Unmarshal(data, &pairs)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			values[pair.Key] = pair.Value
+		}
+	} else if string(data) != "null" {
+		err := json.Unmarshal(data, &values)
+		if err != nil {
+			return err
+		}
+	}
+	*bindings = values
+	return nil
+}
+
+func (card *Card) stringValue(names ...string) string {
+	for _, name := range names {
+		if value := card.BindingValues[name].StringValue; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (card *Card) Title() string {
+	return card.stringValue("title")
+}
+
+func (card *Card) Description() string {
+	return card.stringValue("description")
+}
+
+func (card *Card) Domain() string {
+	return card.stringValue("vanity_url", "domain")
+}
+
+// ThumbnailURL returns the largest preview image of the card.
+func (card *Card) ThumbnailURL() string {
+	for _, name := range []string{
+		"thumbnail_image_original",
+		"summary_photo_image_original",
+		"photo_image_full_size_original",
+		"thumbnail_image_large",
+		"summary_photo_image_large",
+		"thumbnail_image",
+		"summary_photo_image",
+	} {
+		if image := card.BindingValues[name].ImageValue; image != nil && image.URL != "" {
+			return image.URL
+		}
+	}
+	return ""
+}
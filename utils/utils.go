@@ -42,6 +42,19 @@ func FormatUnixTimestamp(unixTimestampStr string, isMs bool) (string, error) {
 	return formattedTime, nil
 }
 
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
 func SleepUntil(wakeupTime time.Time) {
 	now := time.Now()
 	sleepDuration := wakeupTime.Sub(now)
@@ -0,0 +1,73 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	gifExtensionIntroducer = 0x21
+	gifImageSeparator      = 0x2C
+	gifTrailer             = 0x3B
+)
+
+// validateGIF walks the extension and image blocks of a GIF until its trailer.
+func validateGIF(data []byte) error {
+	// Header (6 bytes) and logical screen descriptor (7 bytes).
+	if len(data) < 13 {
+		return errors.New("gif is truncated inside its header")
+	}
+	offset := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		offset += 3 * (1 << ((flags & 0x07) + 1))
+	}
+
+	for {
+		if offset >= len(data) {
+			return errors.New("gif is truncated before its trailer")
+		}
+		block := data[offset]
+		offset++
+
+		switch block {
+		case gifTrailer:
+			return nil
+		case gifExtensionIntroducer:
+			// Extension label followed by data sub-blocks.
+			offset++
+		case gifImageSeparator:
+			if offset+9 > len(data) {
+				return errors.New("gif is truncated inside an image descriptor")
+			}
+			flags := data[offset+8]
+			offset += 9
+			if flags&0x80 != 0 {
+				offset += 3 * (1 << ((flags & 0x07) + 1))
+			}
+			// LZW minimum code size followed by data sub-blocks.
+			offset++
+		default:
+			return fmt.Errorf("gif has an unknown block 0x%X at offset %d", block, offset-1)
+		}
+
+		var err error
+		offset, err = skipGIFSubBlocks(data, offset)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func skipGIFSubBlocks(data []byte, offset int) (int, error) {
+	for {
+		if offset >= len(data) {
+			return 0, errors.New("gif is truncated inside a data sub-block")
+		}
+		size := int(data[offset])
+		offset++
+		if size == 0 {
+			return offset, nil
+		}
+		offset += size
+	}
+}
@@ -0,0 +1,71 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	jpegMarkerSOI = 0xD8
+	jpegMarkerEOI = 0xD9
+	jpegMarkerSOS = 0xDA
+	jpegMarkerTEM = 0x01
+	jpegMarkerRST = 0xD0
+)
+
+func isStandaloneJPEGMarker(marker byte) bool {
+	return marker == jpegMarkerTEM || (marker >= jpegMarkerRST && marker <= jpegMarkerRST+7)
+}
+
+// validateJPEG walks the marker segments from SOI until EOI, skipping over the
+// entropy coded data that follows each SOS segment.
+func validateJPEG(data []byte) error {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegMarkerSOI {
+		return errors.New("jpeg is missing its start of image marker")
+	}
+
+	offset := 2
+	for {
+		// Markers may be preceded by any number of 0xFF fill bytes.
+		if offset >= len(data) || data[offset] != 0xFF {
+			return fmt.Errorf("jpeg is truncated or corrupt at offset %d", offset)
+		}
+		for offset < len(data) && data[offset] == 0xFF {
+			offset++
+		}
+		if offset >= len(data) {
+			return errors.New("jpeg is truncated before its end of image marker")
+		}
+		marker := data[offset]
+		offset++
+
+		if marker == jpegMarkerEOI {
+			return nil
+		}
+		if isStandaloneJPEGMarker(marker) {
+			continue
+		}
+		if offset+2 > len(data) {
+			return errors.New("jpeg is truncated inside a segment header")
+		}
+		length := int(data[offset])<<8 | int(data[offset+1])
+		if length < 2 || offset+length > len(data) {
+			return fmt.Errorf("jpeg segment 0x%X at offset %d extends past the end of the file", marker, offset)
+		}
+		offset += length
+
+		if marker == jpegMarkerSOS {
+			// Scan data ends at the first marker that is neither a stuffed
+			// zero byte nor a restart marker.
+			for {
+				if offset+1 >= len(data) {
+					return errors.New("jpeg is truncated inside its scan data")
+				}
+				if data[offset] == 0xFF && data[offset+1] != 0x00 && !isStandaloneJPEGMarker(data[offset+1]) && data[offset+1] != 0xFF {
+					break
+				}
+				offset++
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package validator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+func isMP4BoxType(boxType string) bool {
+	switch boxType {
+	case "ftyp", "styp", "moov", "mdat", "free", "skip", "wide":
+		return true
+	}
+	return false
+}
+
+// validateMP4 checks that the top level boxes exactly cover the file and that
+// both the movie metadata and the media data are present.
+func validateMP4(data []byte) error {
+	boxes := make(map[string]bool)
+	offset := uint64(0)
+	length := uint64(len(data))
+	for offset < length {
+		if offset+8 > length {
+			return fmt.Errorf("mp4 ends in the middle of a box header at offset %d", offset)
+		}
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		boxType := string(data[offset+4 : offset+8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			// The last box may extend to the end of the file.
+			size = length - offset
+		case 1:
+			if offset+16 > length {
+				return fmt.Errorf("mp4 ends in the middle of a box header at offset %d", offset)
+			}
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			headerSize = 16
+		}
+		if size < headerSize || size > length-offset {
+			return fmt.Errorf("mp4 box %q at offset %d extends past the end of the file", boxType, offset)
+		}
+		if offset == 0 && boxType != "ftyp" && boxType != "styp" {
+			return fmt.Errorf("mp4 starts with box %q instead of ftyp", boxType)
+		}
+		boxes[boxType] = true
+		offset += size
+	}
+
+	if !boxes["moov"] {
+		return errors.New("mp4 has no moov box")
+	}
+	if !boxes["mdat"] {
+		return errors.New("mp4 has no mdat box")
+	}
+	return nil
+}
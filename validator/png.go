@@ -0,0 +1,36 @@
+package validator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// validatePNG checks the length and CRC of every chunk from IHDR to IEND.
+func validatePNG(data []byte) error {
+	offset := len(pngSignature)
+	for index := 0; ; index++ {
+		if offset+8 > len(data) {
+			return errors.New("png is truncated before its IEND chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		chunkType := string(data[offset+4 : offset+8])
+		if index == 0 && chunkType != "IHDR" {
+			return fmt.Errorf("png starts with chunk %q instead of IHDR", chunkType)
+		}
+		if length < 0 || offset+12+length > len(data) {
+			return fmt.Errorf("png chunk %q at offset %d extends past the end of the file", chunkType, offset)
+		}
+		expected := binary.BigEndian.Uint32(data[offset+8+length:])
+		if crc32.ChecksumIEEE(data[offset+4:offset+8+length]) != expected {
+			return fmt.Errorf("png chunk %q at offset %d has a bad crc", chunkType, offset)
+		}
+		offset += 12 + length
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+func isTSPacketStart(data []byte) bool {
+	return len(data) >= 1 && data[0] == tsSyncByte && (len(data) <= tsPacketSize || data[tsPacketSize] == tsSyncByte)
+}
+
+// validateTS checks that an MPEG transport stream is made of whole packets,
+// each starting with the sync byte.
+func validateTS(data []byte) error {
+	if len(data) < tsPacketSize {
+		return errors.New("transport stream is truncated inside its first packet")
+	}
+	for offset := 0; offset < len(data); offset += tsPacketSize {
+		if data[offset] != tsSyncByte {
+			return fmt.Errorf("transport stream packet at offset %d has no sync byte", offset)
+		}
+		if offset+tsPacketSize > len(data) {
+			return fmt.Errorf("transport stream ends in the middle of a packet at offset %d", offset)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	FORMAT_JPEG = "jpeg"
+	FORMAT_PNG  = "png"
+	FORMAT_GIF  = "gif"
+	FORMAT_MP4  = "mp4"
+	FORMAT_TS   = "ts"
+	FORMAT_WEBP = "webp"
+)
+
+var ErrEmpty = errors.New("file is empty")
+
+// DetectFormat returns the media format of data based on its magic bytes, or an
+// empty string when it is none of the supported formats.
+func DetectFormat(data []byte) string {
+	switch {
+	case len(data) >= 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF:
+		return FORMAT_JPEG
+	case len(data) >= len(pngSignature) && string(data[:len(pngSignature)]) == pngSignature:
+		return FORMAT_PNG
+	case len(data) >= 6 && (string(data[:6]) == "GIF87a" || string(data[:6]) == "GIF89a"):
+		return FORMAT_GIF
+	case isWebP(data):
+		return FORMAT_WEBP
+	case len(data) >= 8 && isMP4BoxType(string(data[4:8])):
+		return FORMAT_MP4
+	case isTSPacketStart(data):
+		return FORMAT_TS
+	}
+	return ""
+}
+
+// expectedFormats lists the formats acceptable for a file name. Images are not
+// tied to their extension since photos are stored as .jpg whatever their
+// actual encoding.
+func expectedFormats(filename string) []string {
+	switch strings.ToLower(filepath.Ext(strings.TrimSpace(filename))) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return []string{FORMAT_JPEG, FORMAT_PNG, FORMAT_GIF, FORMAT_WEBP}
+	case ".mp4", ".m4a", ".m4v":
+		return []string{FORMAT_MP4}
+	case ".ts":
+		return []string{FORMAT_TS}
+	}
+	return nil
+}
+
+// Validate checks that data is a complete, structurally valid media file of a
+// format that matches filename. Files with an unknown extension are accepted
+// as long as they are not empty.
+func Validate(filename string, data []byte) error {
+	if len(data) == 0 {
+		return ErrEmpty
+	}
+
+	expected := expectedFormats(filename)
+	if expected == nil {
+		return nil
+	}
+	format := DetectFormat(data)
+	matches := false
+	for _, candidate := range expected {
+		if candidate == format {
+			matches = true
+			break
+		}
+	}
+	if !matches {
+		return fmt.Errorf("content is not a valid %s file, detected %s", strings.Join(expected, "/"), http.DetectContentType(data))
+	}
+
+	switch format {
+	case FORMAT_JPEG:
+		return validateJPEG(data)
+	case FORMAT_PNG:
+		return validatePNG(data)
+	case FORMAT_GIF:
+		return validateGIF(data)
+	case FORMAT_MP4:
+		return validateMP4(data)
+	case FORMAT_TS:
+		return validateTS(data)
+	case FORMAT_WEBP:
+		return validateWebP(data)
+	}
+	return nil
+}
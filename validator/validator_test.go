@@ -0,0 +1,160 @@
+package validator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage() image.Image {
+	img := image.NewPaletted(image.Rect(0, 0, 16, 16), []color.Color{color.Black, color.White})
+	for x := 0; x < 16; x++ {
+		img.SetColorIndex(x, x, 1)
+	}
+	return img
+}
+
+func encodeImage(t *testing.T, encode func(*bytes.Buffer, image.Image) error) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := encode(&buffer, testImage()); err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func mp4Box(boxType string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], boxType)
+	return append(box, payload...)
+}
+
+func riffChunk(chunkType string, payload []byte) []byte {
+	chunk := make([]byte, 8, 8+len(payload)+1)
+	copy(chunk, chunkType)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	file := make([]byte, 8, 8+len(body))
+	copy(file, "RIFF")
+	binary.LittleEndian.PutUint32(file[4:], uint32(len(body)))
+	return append(file, body...)
+}
+
+func tsPackets(count int) []byte {
+	data := make([]byte, 0, count*tsPacketSize)
+	for i := 0; i < count; i++ {
+		packet := make([]byte, tsPacketSize)
+		packet[0] = tsSyncByte
+		data = append(data, packet...)
+	}
+	return data
+}
+
+const htmlErrorPage = "<!DOCTYPE html><html><head><title>Error</title></head><body>Something went wrong</body></html>"
+
+func TestValidate(t *testing.T) {
+	jpegData := encodeImage(t, func(buffer *bytes.Buffer, img image.Image) error {
+		return jpeg.Encode(buffer, img, nil)
+	})
+	pngData := encodeImage(t, func(buffer *bytes.Buffer, img image.Image) error {
+		return png.Encode(buffer, img)
+	})
+	gifData := encodeImage(t, func(buffer *bytes.Buffer, img image.Image) error {
+		return gif.Encode(buffer, img, nil)
+	})
+	webpData := webpFile(riffChunk("VP8L", []byte{0x2F, 0x00, 0x00, 0x00, 0x00}))
+	mp4Data := bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("isom\x00\x00\x02\x00")),
+		mp4Box("moov", make([]byte, 16)),
+		mp4Box("mdat", make([]byte, 64)),
+	}, nil)
+	tsData := tsPackets(3)
+
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		valid    bool
+	}{
+		{"jpeg", "1_2.jpg", jpegData, true},
+		{"truncated jpeg", "1_2.jpg", jpegData[:len(jpegData)/2], false},
+		{"png", "1_2.png", pngData, true},
+		{"png saved as jpg", "1_2.jpg", pngData, true},
+		{"truncated png", "1_2.png", pngData[:len(pngData)-6], false},
+		{"gif", "1_2.gif", gifData, true},
+		{"truncated gif", "1_2.gif", gifData[:len(gifData)-1], false},
+		{"webp", "1_2.webp", webpData, true},
+		{"truncated webp", "1_2.webp", webpData[:len(webpData)-2], false},
+		{"webp without image chunk", "1_2.webp", webpFile(riffChunk("EXIF", []byte{1, 2})), false},
+		{"mp4", "1_2_832000.mp4", mp4Data, true},
+		{"truncated mp4", "1_2_832000.mp4", mp4Data[:len(mp4Data)-10], false},
+		{"mp4 without moov", "1_2_832000.mp4", mp4Box("ftyp", []byte("isom")), false},
+		{"m4a", "1_2.m4a", mp4Data, true},
+		{"ts", "1_2.ts", tsData, true},
+		{"truncated ts", "1_2.ts", tsData[:len(tsData)-100], false},
+		{"corrupt ts", "1_2.ts", append(tsPackets(1), make([]byte, tsPacketSize)...), false},
+		{"html saved as jpg", "1_2.jpg", []byte(htmlErrorPage), false},
+		{"html saved as webp", "1_2.webp", []byte(htmlErrorPage), false},
+		{"html saved as mp4", "1_2.mp4", []byte(htmlErrorPage), false},
+		{"image saved as mp4", "1_2.mp4", pngData, false},
+		{"unknown extension", "1_2.bin", []byte(htmlErrorPage), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(test.filename, test.data)
+			if test.valid && err != nil {
+				t.Errorf("Validate(%s) = %v, want no error", test.filename, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("Validate(%s) accepted invalid content", test.filename)
+			}
+		})
+	}
+}
+
+func TestValidateEmpty(t *testing.T) {
+	for _, filename := range []string{"1_2.jpg", "1_2.mp4", "1_2.bin"} {
+		if err := Validate(filename, nil); !errors.Is(err, ErrEmpty) {
+			t.Errorf("Validate(%s, nil) = %v, want %v", filename, err, ErrEmpty)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0}, FORMAT_JPEG},
+		{"png", []byte(pngSignature + "rest"), FORMAT_PNG},
+		{"gif", []byte("GIF89a......"), FORMAT_GIF},
+		{"webp", webpFile(), FORMAT_WEBP},
+		{"mp4", mp4Box("ftyp", nil), FORMAT_MP4},
+		{"ts", tsPackets(2), FORMAT_TS},
+		{"html", []byte(htmlErrorPage), ""},
+	}
+	for _, test := range tests {
+		if format := DetectFormat(test.data); format != test.format {
+			t.Errorf("DetectFormat(%s) = %q, want %q", test.name, format, test.format)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package validator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// validateWebP checks that the RIFF container holds the whole file and that its
+// chunks exactly cover it, starting with an image chunk.
+func validateWebP(data []byte) error {
+	riffSize := uint64(binary.LittleEndian.Uint32(data[4:8]))
+	if riffSize+8 > uint64(len(data)) {
+		return fmt.Errorf("webp is truncated, its header announces %d bytes and the file has %d", riffSize+8, len(data))
+	}
+	end := riffSize + 8
+	offset := uint64(12)
+	for offset < end {
+		if offset+8 > end {
+			return fmt.Errorf("webp ends in the middle of a chunk header at offset %d", offset)
+		}
+		chunkType := string(data[offset : offset+4])
+		if offset == 12 && chunkType != "VP8 " && chunkType != "VP8L" && chunkType != "VP8X" {
+			return fmt.Errorf("webp starts with chunk %q instead of an image chunk", chunkType)
+		}
+		size := uint64(binary.LittleEndian.Uint32(data[offset+4:]))
+		// Chunks are padded to an even size.
+		next := offset + 8 + size + size%2
+		if next > end {
+			return fmt.Errorf("webp chunk %q at offset %d extends past the end of the file", chunkType, offset)
+		}
+		offset = next
+	}
+	if offset == 12 {
+		return errors.New("webp has no chunks")
+	}
+	return nil
+}